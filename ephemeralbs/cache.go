@@ -0,0 +1,134 @@
+package ephemeralbs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+)
+
+// CacheStats is a point-in-time snapshot of the read-through cache counters
+type CacheStats struct {
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	BytesHit     uint64 // bytes served from the cache
+	BytesMissed  uint64 // bytes fetched from the wrapped blockstore
+	CachedBlocks int
+	CachedBytes  int64
+	MaxBytes     int64
+}
+
+// blockCache is a byte-size-bounded LRU of raw block data, safe for concurrent use
+type blockCache struct {
+	maxBytes int64
+
+	mu       sync.Mutex
+	curBytes int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits, misses, evictions, bytesHit, bytesMissed uint64
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newBlockCache(maxBytes int64) *blockCache {
+	return &blockCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, 1<<16),
+	}
+}
+
+func (bc *blockCache) get(c cid.Cid) ([]byte, bool) {
+	bc.mu.Lock()
+	el, found := bc.items[c.KeyString()]
+	if found {
+		bc.ll.MoveToFront(el)
+	}
+	bc.mu.Unlock()
+
+	if !found {
+		atomic.AddUint64(&bc.misses, 1)
+		return nil, false
+	}
+
+	d := el.Value.(*cacheEntry).data
+	atomic.AddUint64(&bc.hits, 1)
+	atomic.AddUint64(&bc.bytesHit, uint64(len(d)))
+	return d, true
+}
+
+func (bc *blockCache) add(c cid.Cid, data []byte) {
+	atomic.AddUint64(&bc.bytesMissed, uint64(len(data)))
+
+	// a block larger than the entire cache is never worth evicting everything for
+	if int64(len(data)) > bc.maxBytes {
+		return
+	}
+
+	k := c.KeyString()
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	// another walker beat us to it
+	if el, found := bc.items[k]; found {
+		bc.ll.MoveToFront(el)
+		return
+	}
+
+	bc.items[k] = bc.ll.PushFront(&cacheEntry{key: k, data: data})
+	bc.curBytes += int64(len(data))
+
+	for bc.curBytes > bc.maxBytes {
+		el := bc.ll.Back()
+		ce := el.Value.(*cacheEntry)
+		bc.ll.Remove(el)
+		delete(bc.items, ce.key)
+		bc.curBytes -= int64(len(ce.data))
+		atomic.AddUint64(&bc.evictions, 1)
+	}
+}
+
+func (bc *blockCache) stats() CacheStats {
+	bc.mu.Lock()
+	cb, cl := bc.curBytes, bc.ll.Len()
+	bc.mu.Unlock()
+
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&bc.hits),
+		Misses:       atomic.LoadUint64(&bc.misses),
+		Evictions:    atomic.LoadUint64(&bc.evictions),
+		BytesHit:     atomic.LoadUint64(&bc.bytesHit),
+		BytesMissed:  atomic.LoadUint64(&bc.bytesMissed),
+		CachedBlocks: cl,
+		CachedBytes:  cb,
+		MaxBytes:     bc.maxBytes,
+	}
+}
+
+// purge drops every cached block, the counters are left as they are
+func (bc *blockCache) purge() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.ll.Init()
+	bc.items = make(map[string]*list.Element, 1<<16)
+	bc.curBytes = 0
+}
+
+// size is a counter-neutral lookup, used by Has() and GetSize()
+func (bc *blockCache) size(c cid.Cid) (int, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	el, found := bc.items[c.KeyString()]
+	if !found {
+		return -1, false
+	}
+	return len(el.Value.(*cacheEntry).data), true
+}
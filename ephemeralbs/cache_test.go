@@ -0,0 +1,129 @@
+package ephemeralbs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	lotusbs "github.com/filecoin-project/lotus/blockstore"
+	blkfmt "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+func TestReadCache(t *testing.T) {
+	ctx := context.Background()
+
+	// 10 bytes each, room for 3 of them
+	var blks []blkfmt.Block
+	for _, s := range []string{"block 0000", "block 1111", "block 2222", "block 3333"} {
+		blks = append(blks, mkBlock(t, cid.DagCBOR, s))
+	}
+	huge := mkBlock(t, cid.DagCBOR, "a block larger than the entire cache")
+
+	wrapped := lotusbs.NewMemory()
+	if err := wrapped.PutMany(ctx, append([]blkfmt.Block{huge}, blks...)); err != nil {
+		t.Fatal(err)
+	}
+	ebs := NewEphemeralBlockstore(wrapped, WithReadCache(30))
+
+	get := func(b blkfmt.Block) {
+		t.Helper()
+		got, err := ebs.Get(ctx, b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.RawData()) != string(b.RawData()) {
+			t.Fatalf("unexpected content of %s", b.Cid())
+		}
+	}
+
+	get(blks[0]) // miss
+	get(blks[1]) // miss
+	get(blks[2]) // miss
+	get(blks[0]) // hit, 0 is now the most recent
+	get(blks[3]) // miss, evicts 1 as the least recent
+	get(blks[0]) // hit
+	get(huge)    // miss, never cached
+	get(huge)    // miss
+
+	// counter-neutral lookups
+	mustHave(t, ebs, blks[2].Cid(), true)
+	if s, err := ebs.GetSize(ctx, blks[3].Cid()); err != nil || s != 10 {
+		t.Fatalf("GetSize: expected 10, got %d ( %v )", s, err)
+	}
+
+	st, enabled := ebs.CacheStats()
+	if !enabled {
+		t.Fatal("cache stats unavailable with the cache enabled")
+	}
+	hugeLen := uint64(len(huge.RawData()))
+	if exp := (CacheStats{
+		Hits:         2,
+		Misses:       6,
+		Evictions:    1,
+		BytesHit:     20,
+		BytesMissed:  40 + 2*hugeLen,
+		CachedBlocks: 3,
+		CachedBytes:  30,
+		MaxBytes:     30,
+	}); !reflect.DeepEqual(st, exp) {
+		t.Fatalf("expected stats %+v, got %+v", exp, st)
+	}
+
+	for i, expCached := range []bool{true, false, true, true} {
+		if _, cached := ebs.e.cache.size(blks[i].Cid()); cached != expCached {
+			t.Fatalf("block %d: expected cached %t, got %t", i, expCached, cached)
+		}
+	}
+
+	if _, enabled := NewEphemeralBlockstore(wrapped).CacheStats(); enabled {
+		t.Fatal("cache stats available without a cache")
+	}
+}
+
+// hashOnReadSpy records whether HashOnRead got passed on to it
+type hashOnReadSpy struct {
+	lotusbs.Blockstore
+	called bool
+}
+
+func (s *hashOnReadSpy) HashOnRead(bool) { s.called = true }
+
+func TestHashOnRead(t *testing.T) {
+	ctx := context.Background()
+
+	good := mkBlock(t, cid.DagCBOR, "block 0000")
+	tampered, err := blkfmt.NewBlockWithCid([]byte("block 9999"), mkBlock(t, cid.DagCBOR, "block 1111").Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped := &hashOnReadSpy{Blockstore: lotusbs.NewMemory()}
+	if err := wrapped.PutMany(ctx, []blkfmt.Block{good, tampered}); err != nil {
+		t.Fatal(err)
+	}
+	ebs := NewEphemeralBlockstore(wrapped, WithReadCache(1<<10))
+
+	// not verified, and thus cached as-is
+	if _, err := ebs.Get(ctx, tampered.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	ebs.HashOnRead(true)
+	if wrapped.called {
+		t.Fatal("HashOnRead passed on to the wrapped blockstore, every block would be hashed twice")
+	}
+	if st, _ := ebs.CacheStats(); st.CachedBlocks != 0 || st.CachedBytes != 0 {
+		t.Fatalf("unverified blocks still cached after enabling verification: %+v", st)
+	}
+
+	if _, err := ebs.Get(ctx, tampered.Cid()); err == nil {
+		t.Fatal("expected a tampered block to fail verification")
+	}
+	if got, err := ebs.Get(ctx, good.Cid()); err != nil || string(got.RawData()) != string(good.RawData()) {
+		t.Fatalf("unexpected result for an intact block: %v", err)
+	}
+	if _, cached := ebs.e.cache.size(tampered.Cid()); cached {
+		t.Fatal("a block failing verification ended up in the cache")
+	}
+}
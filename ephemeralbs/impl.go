@@ -2,6 +2,8 @@ package ephemeralbs
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 
 	lotusbs "github.com/filecoin-project/lotus/blockstore"
 	blkfmt "github.com/ipfs/go-block-format"
@@ -12,44 +14,277 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func NewEphemeralBlockstore(wrapped ipfsbs.Blockstore) lotusbs.Blockstore {
+// Option tweaks the behavior of the blockstore returned by NewEphemeralBlockstore
+type Option func(*ephbs)
 
-	return lotusbs.NewIDStore(&ephbs{
-		ramBs:     lotusbs.FromDatastore(dssync.MutexWrap(ds.NewMapDatastore())),
+// WithReadCache enables a read-through LRU of up to maxBytes worth of blocks
+// served from the wrapped blockstore. Writes never land in this cache: they
+// are kept in the RAM overlay regardless.
+func WithReadCache(maxBytes int64) Option {
+	return func(e *ephbs) {
+		if maxBytes > 0 {
+			e.cache = newBlockCache(maxBytes)
+		}
+	}
+}
+
+// Blockstore is the ID-aware ephemeral overlay, with access to its stats
+type Blockstore struct {
+	lotusbs.Blockstore
+	e *ephbs
+}
+
+// CacheStats returns the current read-cache counters, or false if the cache is not enabled
+func (b *Blockstore) CacheStats() (CacheStats, bool) {
+	if b.e.cache == nil {
+		return CacheStats{}, false
+	}
+	return b.e.cache.stats(), true
+}
+
+// Flush persists all writes and deletions accumulated so far into dst, and
+// empties the overlay. The wrapped blockstore is never written to.
+func (b *Blockstore) Flush(ctx context.Context, dst ipfsbs.Blockstore) error {
+	return b.e.Flush(ctx, dst)
+}
+
+// Discard drops all writes and deletions accumulated so far, exposing the wrapped blockstore as-is
+func (b *Blockstore) Discard() { b.e.Discard() }
+
+func NewEphemeralBlockstore(wrapped ipfsbs.Blockstore, opts ...Option) *Blockstore {
+	e := &ephbs{
 		wrappedBs: wrapped,
-	})
+	}
+	e.reset()
+	for _, o := range opts {
+		o(e)
+	}
+
+	return &Blockstore{
+		Blockstore: lotusbs.NewIDStore(e),
+		e:          e,
+	}
+}
+
+func newRAMBlockstore() lotusbs.Blockstore {
+	return lotusbs.FromDatastore(dssync.MutexWrap(ds.NewMapDatastore()))
 }
 
 type ephbs struct {
-	ramBs     lotusbs.Blockstore
-	wrappedBs ipfsbs.Blockstore
+	ramBs       lotusbs.Blockstore
+	wrappedBs   ipfsbs.Blockstore
+	cache       *blockCache
+	verifyReads int32
+
+	// guards swapping out ramBs on Flush/Discard, and the two maps below
+	// both are keyed by multihash, same as the underlying blockstores, and
+	// retain the CIDs as written: ramBs alone can only return raw-codec ones
+	mu         sync.RWMutex
+	written    map[string]cid.Cid
+	tombstones map[string]cid.Cid
 }
 
 var _ = lotusbs.Blockstore(&ephbs{})
 
-// don't bother
-func (e *ephbs) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
-	return nil, xerrors.Errorf("method AllKeysChan is not supported ")
+// HashOnRead toggles re-hashing of every block fetched from the wrapped blockstore
+// (before it enters the read cache). It is not passed on to the wrapped blockstore,
+// which would only hash every block a second time. Our own RAM overlay is never
+// re-verified.
+func (e *ephbs) HashOnRead(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+		// whatever was cached so far went in unverified
+		if e.cache != nil {
+			e.cache.purge()
+		}
+	}
+	atomic.StoreInt32(&e.verifyReads, v)
+}
+
+// overlay returns the current RAM layer, and whether c has been deleted from the overall view
+func (e *ephbs) overlay(c cid.Cid) (lotusbs.Blockstore, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, deleted := e.tombstones[string(c.Hash())]
+	return e.ramBs, deleted
+}
+
+func (e *ephbs) Put(ctx context.Context, blk blkfmt.Block) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.ramBs.Put(ctx, blk); err != nil {
+		return err
+	}
+	delete(e.tombstones, string(blk.Cid().Hash()))
+	e.written[string(blk.Cid().Hash())] = blk.Cid()
+	return nil
 }
-func (e *ephbs) DeleteMany(context.Context, []cid.Cid) error {
-	return xerrors.Errorf("method DeleteMany is not supported ")
+
+func (e *ephbs) PutMany(ctx context.Context, blks []blkfmt.Block) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.ramBs.PutMany(ctx, blks); err != nil {
+		return err
+	}
+	for _, b := range blks {
+		delete(e.tombstones, string(b.Cid().Hash()))
+		e.written[string(b.Cid().Hash())] = b.Cid()
+	}
+	return nil
 }
-func (e *ephbs) DeleteBlock(context.Context, cid.Cid) error {
-	return xerrors.Errorf("method DeleteBlock is not supported ")
+
+// DeleteBlock removes c from the RAM overlay, and hides any copy in the wrapped blockstore
+func (e *ephbs) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return e.DeleteMany(ctx, []cid.Cid{c})
 }
 
-// whatever
-func (e *ephbs) HashOnRead(enable bool) { e.wrappedBs.HashOnRead(enable) }
+func (e *ephbs) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-// implement the rest properly
-func (e *ephbs) Put(ctx context.Context, blk blkfmt.Block) error { return e.ramBs.Put(ctx, blk) }
+	if err := e.ramBs.DeleteMany(ctx, cids); err != nil {
+		return err
+	}
+	for _, c := range cids {
+		delete(e.written, string(c.Hash()))
+		e.tombstones[string(c.Hash())] = c
+	}
+	return nil
+}
 
-func (e *ephbs) PutMany(ctx context.Context, blks []blkfmt.Block) error {
-	return e.ramBs.PutMany(ctx, blks)
+// AllKeysChan enumerates the RAM overlay first, then the wrapped blockstore,
+// skipping duplicates and deleted entries
+func (e *ephbs) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+
+	// snapshot the state as of the call, so Flush/Discard can not interfere mid-stream
+	e.mu.RLock()
+	ramKeys := make([]cid.Cid, 0, len(e.written))
+	for _, c := range e.written {
+		ramKeys = append(ramKeys, c)
+	}
+	deleted := make(map[string]struct{}, len(e.tombstones))
+	for k := range e.tombstones {
+		deleted[k] = struct{}{}
+	}
+	e.mu.RUnlock()
+
+	// the wrapped enumeration must not outlive ours, whyever ours stops
+	wrappedCtx, cancel := context.WithCancel(ctx)
+	wrappedKeys, err := e.wrappedBs.AllKeysChan(wrappedCtx)
+	if err != nil {
+		cancel()
+		return nil, xerrors.Errorf("unable to enumerate wrapped blockstore: %w", err)
+	}
+
+	out := make(chan cid.Cid, 1<<10)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		seen := make(map[string]struct{}, len(ramKeys))
+		emit := func(c cid.Cid) bool {
+			k := string(c.Hash())
+			if _, skip := deleted[k]; skip {
+				return true
+			}
+			if _, skip := seen[k]; skip {
+				return true
+			}
+			seen[k] = struct{}{}
+
+			select {
+			case out <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, c := range ramKeys {
+			if !emit(c) {
+				return
+			}
+		}
+		for {
+			select {
+			case c, open := <-wrappedKeys:
+				if !open || !emit(c) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Flush writes every block of the RAM overlay into dst, deletes every tombstoned
+// block from dst, and then starts over with an empty overlay
+func (e *ephbs) Flush(ctx context.Context, dst ipfsbs.Blockstore) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	batch := make([]blkfmt.Block, 0, 1<<10)
+	for _, c := range e.written {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rb, err := e.ramBs.Get(ctx, c)
+		if err != nil {
+			return xerrors.Errorf("unable to read %s from RAM overlay: %w", c, err)
+		}
+		// re-wrap with the CID as written, retaining its codec
+		b, err := blkfmt.NewBlockWithCid(rb.RawData(), c)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, b)
+		if len(batch) == cap(batch) {
+			if err := dst.PutMany(ctx, batch); err != nil {
+				return xerrors.Errorf("flushing blocks failed: %w", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := dst.PutMany(ctx, batch); err != nil {
+			return xerrors.Errorf("flushing blocks failed: %w", err)
+		}
+	}
+
+	for _, c := range e.tombstones {
+		if err := dst.DeleteBlock(ctx, c); err != nil && !xerrors.Is(err, ipfsbs.ErrNotFound) {
+			return xerrors.Errorf("flushing deletion of %s failed: %w", c, err)
+		}
+	}
+
+	e.reset()
+	return nil
+}
+
+// Discard drops all writes and deletions accumulated in the RAM overlay
+func (e *ephbs) Discard() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reset()
+}
+
+func (e *ephbs) reset() {
+	e.ramBs = newRAMBlockstore()
+	e.written = make(map[string]cid.Cid)
+	e.tombstones = make(map[string]cid.Cid)
 }
 
 func (e *ephbs) Has(ctx context.Context, c cid.Cid) (bool, error) {
-	ramHas, err := e.ramBs.Has(ctx, c)
+	ramBs, deleted := e.overlay(c)
+	if deleted {
+		return false, nil
+	}
+
+	ramHas, err := ramBs.Has(ctx, c)
 	switch {
 
 	case err != nil:
@@ -59,55 +294,119 @@ func (e *ephbs) Has(ctx context.Context, c cid.Cid) (bool, error) {
 		return ramHas, nil
 
 	default:
+		if e.cache != nil {
+			if _, found := e.cache.size(c); found {
+				return true, nil
+			}
+		}
 		return e.wrappedBs.Has(ctx, c)
 	}
 }
 
 func (e *ephbs) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
-	ramHas, err := e.ramBs.Has(ctx, c)
+	ramBs, deleted := e.overlay(c)
+	if deleted {
+		return ipfsbs.ErrNotFound
+	}
+
+	ramHas, err := ramBs.Has(ctx, c)
 	switch {
 
 	case err != nil:
 		return err
 
 	case ramHas:
-		return e.ramBs.View(ctx, c, callback)
+		return ramBs.View(ctx, c, callback)
 
 	default:
-		b, err := e.wrappedBs.Get(ctx, c)
+		d, err := e.wrappedData(ctx, c)
 		if err != nil {
 			return err
 		}
-		return callback(b.RawData())
+		return callback(d)
 	}
 }
 
 func (e *ephbs) GetSize(ctx context.Context, c cid.Cid) (int, error) {
-	ramHas, err := e.ramBs.Has(ctx, c)
+	ramBs, deleted := e.overlay(c)
+	if deleted {
+		return -1, ipfsbs.ErrNotFound
+	}
+
+	ramHas, err := ramBs.Has(ctx, c)
 	switch {
 
 	case err != nil:
 		return -1, err
 
 	case ramHas:
-		return e.ramBs.GetSize(ctx, c)
+		return ramBs.GetSize(ctx, c)
 
 	default:
+		if e.cache != nil {
+			if s, found := e.cache.size(c); found {
+				return s, nil
+			}
+		}
 		return e.wrappedBs.GetSize(ctx, c)
 	}
 }
 
 func (e *ephbs) Get(ctx context.Context, c cid.Cid) (blkfmt.Block, error) {
-	ramHas, err := e.ramBs.Has(ctx, c)
+	ramBs, deleted := e.overlay(c)
+	if deleted {
+		return nil, ipfsbs.ErrNotFound
+	}
+
+	ramHas, err := ramBs.Has(ctx, c)
 	switch {
 
 	case err != nil:
 		return nil, err
 
 	case ramHas:
-		return e.ramBs.Get(ctx, c)
+		return ramBs.Get(ctx, c)
 
 	default:
-		return e.wrappedBs.Get(ctx, c)
+		d, err := e.wrappedData(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return blkfmt.NewBlockWithCid(d, c)
+	}
+}
+
+func (e *ephbs) wrappedData(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if e.cache != nil {
+		if d, found := e.cache.get(c); found {
+			return d, nil
+		}
+	}
+
+	b, err := e.wrappedBs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if atomic.LoadInt32(&e.verifyReads) == 1 {
+		if err := verifyBlock(c, b.RawData()); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.cache != nil {
+		e.cache.add(c, b.RawData())
+	}
+	return b.RawData(), nil
+}
+
+func verifyBlock(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return xerrors.Errorf("unable to rehash block %s: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return xerrors.Errorf("block %s read from wrapped blockstore fails hash verification: actual content hashes to %s", c, actual)
 	}
+	return nil
 }
@@ -0,0 +1,152 @@
+package ephemeralbs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	lotusbs "github.com/filecoin-project/lotus/blockstore"
+	blkfmt "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipfsbs "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+)
+
+func mkBlock(t *testing.T, codec uint64, data string) blkfmt.Block {
+	t.Helper()
+	mh, err := multihash.Sum([]byte(data), multihash.BLAKE2B_MIN+31, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blkfmt.NewBlockWithCid([]byte(data), cid.NewCidV1(codec, mh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func collectKeys(t *testing.T, ch <-chan cid.Cid) []string {
+	t.Helper()
+	var keys []string
+	for c := range ch {
+		keys = append(keys, c.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCids(cids ...cid.Cid) []string {
+	keys := make([]string, len(cids))
+	for i, c := range cids {
+		keys[i] = c.String()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mustHave(t *testing.T, bs ipfsbs.Blockstore, c cid.Cid, expected bool) {
+	t.Helper()
+	has, err := bs.Has(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has != expected {
+		t.Fatalf("Has(%s): expected %t, got %t", c, expected, has)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+
+	wrappedA := mkBlock(t, cid.DagCBOR, "wrapped A")
+	wrappedB := mkBlock(t, cid.DagCBOR, "wrapped B")
+	wrapped := lotusbs.NewMemory()
+	if err := wrapped.PutMany(ctx, []blkfmt.Block{wrappedA, wrappedB}); err != nil {
+		t.Fatal(err)
+	}
+
+	ebs := NewEphemeralBlockstore(wrapped)
+
+	// different codecs: both must survive the multihash-keyed RAM overlay
+	putC := mkBlock(t, cid.DagCBOR, "put C")
+	putD := mkBlock(t, cid.DagProtobuf, "put D")
+	if err := ebs.PutMany(ctx, []blkfmt.Block{putC, putD}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a tombstone hides the wrapped copy
+	if err := ebs.DeleteBlock(ctx, wrappedA.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	mustHave(t, ebs, wrappedA.Cid(), false)
+	if _, err := ebs.Get(ctx, wrappedA.Cid()); err != ipfsbs.ErrNotFound {
+		t.Fatalf("expected ErrNotFound for a deleted block, got %v", err)
+	}
+	mustHave(t, wrapped, wrappedA.Cid(), true)
+
+	keys, err := ebs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := collectKeys(t, keys), sortedCids(wrappedB.Cid(), putC.Cid(), putD.Cid()); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("AllKeysChan: expected %v, got %v", exp, got)
+	}
+
+	// a consumer walking away after the first key must not leave the enumeration hanging
+	stopCtx, stop := context.WithCancel(ctx)
+	keys, err = ebs.AllKeysChan(stopCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-keys
+	stop()
+	deadline := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-keys:
+		case <-deadline:
+			t.Fatal("AllKeysChan did not close its channel after cancellation")
+		}
+	}
+
+	// dst is keyed by full CID: a codec lost along the way would fail Has()
+	dst := lotusbs.NewMemory()
+	if err := dst.Put(ctx, wrappedA); err != nil {
+		t.Fatal(err)
+	}
+	if err := ebs.Flush(ctx, dst); err != nil {
+		t.Fatal(err)
+	}
+	mustHave(t, dst, putC.Cid(), true)
+	mustHave(t, dst, putD.Cid(), true)
+	mustHave(t, dst, wrappedA.Cid(), false)
+	mustHave(t, wrapped, putC.Cid(), false)
+
+	// the overlay starts over: the tombstone is gone, and so are the writes
+	mustHave(t, ebs, wrappedA.Cid(), true)
+	mustHave(t, ebs, putC.Cid(), false)
+
+	putE := mkBlock(t, cid.Raw, "put E")
+	if err := ebs.Put(ctx, putE); err != nil {
+		t.Fatal(err)
+	}
+	if err := ebs.DeleteBlock(ctx, wrappedB.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	mustHave(t, ebs, putE.Cid(), true)
+	mustHave(t, ebs, wrappedB.Cid(), false)
+
+	ebs.Discard()
+	mustHave(t, ebs, putE.Cid(), false)
+	mustHave(t, ebs, wrappedB.Cid(), true)
+
+	keys, err = ebs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := collectKeys(t, keys), sortedCids(wrappedA.Cid(), wrappedB.Cid()); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("AllKeysChan after Discard: expected %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,440 @@
+// main is main is main
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/georgysavva/scany/sqlscan"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/parquet-go/parquet-go"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultDbFn   = `data/filstate_2162760.sqlite`
+	defaultOutDir = `data/export_2162760`
+	manifestName  = `MANIFEST.json`
+)
+
+// rows per parquet row group, and per read batch
+const batchRows = 1 << 16
+
+type manifest struct {
+	SourceDB       string
+	SourceDBSha256 string
+	Tables         []manifestTable
+}
+
+type manifestTable struct {
+	Table   string
+	OrderBy string
+	Rows    int64
+	Files   []manifestFile
+}
+
+type manifestFile struct {
+	Name   string
+	Sha256 string
+	Size   int64
+}
+
+func main() {
+	ctx := context.Background()
+
+	dbFn := flag.String("db", defaultDbFn, "state database produced by parsestate ( and optionally updatevotes )")
+	outDir := flag.String("out", defaultOutDir, "directory to write <table>.parquet, <table>.csv.gz and "+manifestName+" into")
+	flag.Parse()
+
+	if err := exportAll(ctx, *dbFn, *outDir); err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
+
+func exportAll(ctx context.Context, dbFn, outDir string) error {
+
+	db, err := sql.Open("sqlite3", dbFn+"?mode=ro")
+	if err != nil {
+		return xerrors.Errorf("failed to open state database %s: %w", dbFn, err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return xerrors.Errorf("unable to create output directory %s: %w", outDir, err)
+	}
+
+	dbHash, _, err := hashFile(dbFn)
+	if err != nil {
+		return err
+	}
+	m := manifest{
+		SourceDB:       path.Base(dbFn),
+		SourceDBSha256: dbHash,
+	}
+
+	var hasVotes bool
+	if err := db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'votes'`,
+	).Scan(&hasVotes); err != nil {
+		return err
+	}
+
+	exports := []tableExport{
+		{"deals", "deal_id", exportTable[dealRow]},
+		{"providers", "provider_id", exportTable[providerRow]},
+		{"accounts", "account_id", exportTable[accountRow]},
+		{"msigs", "msig_id", exportTable[msigRow]},
+		{"msig_actors", "msig_id, actor_id", exportTable[msigActorRow]},
+	}
+	if hasVotes {
+		exports = append(exports, tableExport{"votes", "actor_id", exportTable[voteRow]})
+	} else {
+		log.Printf("no votes table in %s ( updatevotes not yet ran ), skipping", dbFn)
+	}
+
+	for _, e := range exports {
+		mt, err := e.export(ctx, db, outDir, e.table, e.orderBy)
+		if err != nil {
+			return err
+		}
+		log.Printf("exported %d rows from %s", mt.Rows, mt.Table)
+		m.Tables = append(m.Tables, *mt)
+	}
+
+	mj, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(outDir, manifestName), append(mj, '\n'), 0o644)
+}
+
+type tableExport struct {
+	table   string
+	orderBy string
+	export  func(ctx context.Context, db *sql.DB, outDir, table, orderBy string) (*manifestTable, error)
+}
+
+type exportRow interface {
+	csvRecord() []string
+	// selectList is the column list for the SELECT, in struct field order
+	selectList() string
+}
+
+func exportTable[T exportRow](ctx context.Context, db *sql.DB, outDir, table, orderBy string) (*manifestTable, error) {
+
+	var zero T
+	pqSchema := parquet.SchemaOf(zero)
+	cols := make([]string, 0, len(pqSchema.Fields()))
+	for _, f := range pqSchema.Fields() {
+		cols = append(cols, f.Name())
+	}
+
+	pqFn := path.Join(outDir, table+".parquet")
+	pqFh, err := os.Create(pqFn)
+	if err != nil {
+		return nil, err
+	}
+	defer pqFh.Close() //nolint:errcheck
+
+	csvFn := path.Join(outDir, table+".csv.gz")
+	csvFh, err := os.Create(csvFn)
+	if err != nil {
+		return nil, err
+	}
+	defer csvFh.Close() //nolint:errcheck
+
+	pqW := parquet.NewGenericWriter[T](
+		pqFh,
+		// the default embeds the library's build info: pin it down for reproducibility
+		parquet.CreatedBy("fil-fip36-vote-tally", "", ""),
+		parquet.Compression(&parquet.Zstd),
+		parquet.PageBufferSize(1<<20),
+	)
+
+	// no name, no mtime in the gzip header: the output depends on the data alone
+	gzW, err := gzip.NewWriterLevel(csvFh, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	csvW := csv.NewWriter(gzW)
+	if err := csvW.Write(cols); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT %s FROM %s ORDER BY %s`,
+			zero.selectList(),
+			table,
+			orderBy,
+		),
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to query %s: %w", table, err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	rs := sqlscan.NewRowScanner(rows)
+	batch := make([]T, 0, batchRows)
+	var total int64
+
+	flushBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := pqW.Write(batch); err != nil {
+			return xerrors.Errorf("parquet write to %s failed: %w", pqFn, err)
+		}
+		if err := pqW.Flush(); err != nil {
+			return xerrors.Errorf("parquet write to %s failed: %w", pqFn, err)
+		}
+		for i := range batch {
+			if err := csvW.Write(batch[i].csvRecord()); err != nil {
+				return xerrors.Errorf("csv write to %s failed: %w", csvFn, err)
+			}
+		}
+		total += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		var r T
+		if err := rs.Scan(&r); err != nil {
+			return nil, xerrors.Errorf("unable to scan row of %s: %w", table, err)
+		}
+		batch = append(batch, r)
+		if len(batch) == batchRows {
+			if err := flushBatch(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := flushBatch(); err != nil {
+		return nil, err
+	}
+
+	if err := pqW.Close(); err != nil {
+		return nil, xerrors.Errorf("parquet finalization of %s failed: %w", pqFn, err)
+	}
+	csvW.Flush()
+	if err := csvW.Error(); err != nil {
+		return nil, err
+	}
+	if err := gzW.Close(); err != nil {
+		return nil, err
+	}
+
+	mt := &manifestTable{
+		Table:   table,
+		OrderBy: orderBy,
+		Rows:    total,
+	}
+	for _, fn := range []string{pqFn, csvFn} {
+		h, sz, err := hashFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		mt.Files = append(mt.Files, manifestFile{
+			Name:   path.Base(fn),
+			Sha256: h,
+			Size:   sz,
+		})
+	}
+
+	return mt, nil
+}
+
+func hashFile(fn string) (string, int64, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	h := sha256.New()
+	sz, err := io.Copy(h, fh)
+	if err != nil {
+		return "", 0, xerrors.Errorf("unable to hash %s: %w", fn, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), sz, nil
+}
+
+//
+// Per-table row shapes: field order is column order in both outputs
+//
+
+type dealRow struct {
+	DealID                int64  `db:"deal_id" parquet:"deal_id,delta"`
+	ClientID              int64  `db:"client_id" parquet:"client_id"`
+	ProviderID            int64  `db:"provider_id" parquet:"provider_id"`
+	PieceCid              string `db:"piece_cid" parquet:"piece_cid"`
+	Label                 []byte `db:"label" parquet:"label"`
+	PieceSize             int64  `db:"piece_size" parquet:"piece_size"`
+	IsFilplus             bool   `db:"is_filplus" parquet:"is_filplus"`
+	PricePerEpoch         int64  `db:"price_per_epoch" parquet:"price_per_epoch"`
+	ProviderCollateral    int64  `db:"provider_collateral" parquet:"provider_collateral"`
+	ClientCollateral      int64  `db:"client_collateral" parquet:"client_collateral"`
+	StartEpoch            int64  `db:"start_epoch" parquet:"start_epoch"`
+	EndEpoch              int64  `db:"end_epoch" parquet:"end_epoch"`
+	SectorActivationEpoch *int64 `db:"sector_activation_epoch" parquet:"sector_activation_epoch,optional"`
+	DealSlashEpoch        *int64 `db:"deal_slash_epoch" parquet:"deal_slash_epoch,optional"`
+}
+
+func (r dealRow) selectList() string { return dbColumns(r) }
+
+func (r dealRow) csvRecord() []string {
+	return []string{
+		csvInt(r.DealID),
+		csvInt(r.ClientID),
+		csvInt(r.ProviderID),
+		r.PieceCid,
+		csvBytes(r.Label),
+		csvInt(r.PieceSize),
+		strconv.FormatBool(r.IsFilplus),
+		csvInt(r.PricePerEpoch),
+		csvInt(r.ProviderCollateral),
+		csvInt(r.ClientCollateral),
+		csvInt(r.StartEpoch),
+		csvInt(r.EndEpoch),
+		csvIntPtr(r.SectorActivationEpoch),
+		csvIntPtr(r.DealSlashEpoch),
+	}
+}
+
+type providerRow struct {
+	ProviderID int64  `db:"provider_id" parquet:"provider_id,delta"`
+	OwnerID    int64  `db:"owner_id" parquet:"owner_id"`
+	WorkerID   int64  `db:"worker_id" parquet:"worker_id"`
+	PowerRaw   string `db:"power_raw" parquet:"power_raw"`
+	PowerQa    string `db:"power_qa" parquet:"power_qa"`
+	Balance    string `db:"balance" parquet:"balance"`
+}
+
+func (r providerRow) selectList() string { return dbColumns(r) }
+
+func (r providerRow) csvRecord() []string {
+	return []string{
+		csvInt(r.ProviderID),
+		csvInt(r.OwnerID),
+		csvInt(r.WorkerID),
+		r.PowerRaw,
+		r.PowerQa,
+		r.Balance,
+	}
+}
+
+type accountRow struct {
+	AccountID      int64  `db:"account_id" parquet:"account_id,delta"`
+	AccountAddress string `db:"account_address" parquet:"account_address"`
+	Balance        string `db:"balance" parquet:"balance"`
+}
+
+func (r accountRow) selectList() string { return dbColumns(r) }
+
+func (r accountRow) csvRecord() []string {
+	return []string{
+		csvInt(r.AccountID),
+		r.AccountAddress,
+		r.Balance,
+	}
+}
+
+type msigRow struct {
+	MsigID    int64  `db:"msig_id" parquet:"msig_id,delta"`
+	Threshold int32  `db:"threshold" parquet:"threshold"`
+	Balance   string `db:"balance" parquet:"balance"`
+}
+
+func (r msigRow) selectList() string { return dbColumns(r) }
+
+func (r msigRow) csvRecord() []string {
+	return []string{
+		csvInt(r.MsigID),
+		csvInt(int64(r.Threshold)),
+		r.Balance,
+	}
+}
+
+type msigActorRow struct {
+	MsigID  int64 `db:"msig_id" parquet:"msig_id,delta"`
+	ActorID int64 `db:"actor_id" parquet:"actor_id"`
+}
+
+func (r msigActorRow) selectList() string { return dbColumns(r) }
+
+func (r msigActorRow) csvRecord() []string {
+	return []string{
+		csvInt(r.MsigID),
+		csvInt(r.ActorID),
+	}
+}
+
+type voteRow struct {
+	ActorID      int64  `db:"actor_id" parquet:"actor_id,delta"`
+	DoesAccept   bool   `db:"does_accept" parquet:"does_accept"`
+	VoteReceived *int64 `db:"vote_received_ms" parquet:"vote_received_ms,optional"`
+}
+
+// go-sqlite3 stores time.Time as text, turn it into epoch-milliseconds
+func (voteRow) selectList() string {
+	return `actor_id, does_accept,
+		CAST( strftime( '%s', vote_received ) AS INTEGER ) * 1000
+			+ CAST( substr( strftime( '%f', vote_received ), 4 ) AS INTEGER )
+		AS vote_received_ms`
+}
+
+func (r voteRow) csvRecord() []string {
+	return []string{
+		csvInt(r.ActorID),
+		strconv.FormatBool(r.DoesAccept),
+		csvIntPtr(r.VoteReceived),
+	}
+}
+
+// dbColumns lists the `db` tags of a row struct, in field order
+func dbColumns(row interface{}) string {
+	t := reflect.TypeOf(row)
+	cols := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		cols = append(cols, t.Field(i).Tag.Get("db"))
+	}
+	return strings.Join(cols, ", ")
+}
+
+func csvInt(i int64) string { return strconv.FormatInt(i, 10) }
+
+func csvIntPtr(i *int64) string {
+	if i == nil {
+		return ""
+	}
+	return csvInt(*i)
+}
+
+// labels are arbitrary bytes: anything that is not valid UTF-8 is hex-encoded with a 0x prefix
+func csvBytes(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return "0x" + hex.EncodeToString(b)
+}
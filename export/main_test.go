@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a state DB with rows inserted out of order, a non-UTF-8 label, NULLs, and votes
+func writeStateDB(t *testing.T, fn string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	received := time.Date(2022, 9, 20, 12, 0, 0, 250_000_000, time.UTC)
+	for _, s := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{sql: `CREATE TABLE deals ( deal_id BIGINT, client_id INTEGER, provider_id INTEGER, piece_cid TEXT, label TEXT, piece_size BIGINT, is_filplus BOOLEAN, price_per_epoch BIGINT, provider_collateral BIGINT, client_collateral BIGINT, start_epoch INTEGER, end_epoch INTEGER, sector_activation_epoch INTEGER, deal_slash_epoch INTEGER )`},
+		{sql: `CREATE TABLE providers ( provider_id INTEGER, owner_id INTEGER, worker_id INTEGER, power_raw TEXT, power_qa TEXT, balance TEXT )`},
+		{sql: `CREATE TABLE accounts ( account_id INTEGER, account_address TEXT, balance TEXT )`},
+		{sql: `CREATE TABLE msigs ( msig_id INTEGER, threshold SMALLINT, balance TEXT )`},
+		{sql: `CREATE TABLE msig_actors ( msig_id INTEGER, actor_id INTEGER )`},
+		{sql: `CREATE TABLE votes ( actor_id INTEGER, does_accept BOOL, vote_received DATETIME )`},
+		{sql: `INSERT INTO deals VALUES ( 7, 100, 300, 'bafypiece7', $1, 2048, true, 3, 4, 5, 600, 900, NULL, NULL )`, args: []interface{}{[]byte{0xff, 0x00, 0x42}}},
+		{sql: `INSERT INTO deals VALUES ( 3, 101, 300, 'bafypiece3', 'a label', 1024, false, 0, 1, 2, 500, 800, 450, 700 )`},
+		{sql: `INSERT INTO providers VALUES ( 300, 100, 101, '34359738368', '343597383680', '7000' )`},
+		{sql: `INSERT INTO accounts VALUES ( 101, 'f1bob', '2000000' ), ( 100, 'f1alice', '1000000' )`},
+		{sql: `INSERT INTO msigs VALUES ( 200, 2, '5000' )`},
+		{sql: `INSERT INTO msig_actors VALUES ( 200, 101 ), ( 200, 100 )`},
+		{sql: `INSERT INTO votes VALUES ( 101, false, $1 ), ( 100, true, NULL )`, args: []interface{}{received}},
+	} {
+		if _, err := db.Exec(s.sql, s.args...); err != nil {
+			t.Fatalf("%s: %s", s.sql, err)
+		}
+	}
+}
+
+func readCsvGz(t *testing.T, fn string) [][]string {
+	t.Helper()
+	fh, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close() //nolint:errcheck
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := csv.NewReader(gz).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestExportAll(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbFn := filepath.Join(dir, "state.sqlite")
+	writeStateDB(t, dbFn)
+
+	outA, outB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, out := range []string{outA, outB} {
+		if err := exportAll(ctx, dbFn, out); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	// two exports of the same DB are byte-identical, manifest included
+	entries, err := os.ReadDir(outA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2*6+1 {
+		t.Fatalf("expected 13 files in the export, got %d", len(entries))
+	}
+	for _, e := range entries {
+		a, err := os.ReadFile(filepath.Join(outA, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(outB, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s differs between two exports of the same DB", e.Name())
+		}
+	}
+
+	mj, err := os.ReadFile(filepath.Join(outA, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(mj, &m); err != nil {
+		t.Fatal(err)
+	}
+	dbHash, _, err := hashFile(dbFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SourceDB != "state.sqlite" || m.SourceDBSha256 != dbHash {
+		t.Errorf("unexpected source in manifest: %s %s", m.SourceDB, m.SourceDBSha256)
+	}
+
+	expRows := map[string]int64{"deals": 2, "providers": 1, "accounts": 2, "msigs": 1, "msig_actors": 2, "votes": 2}
+	if len(m.Tables) != len(expRows) {
+		t.Fatalf("expected %d tables in manifest, got %d", len(expRows), len(m.Tables))
+	}
+	for _, mt := range m.Tables {
+		if mt.Rows != expRows[mt.Table] {
+			t.Errorf("table %s: manifest lists %d rows, expected %d", mt.Table, mt.Rows, expRows[mt.Table])
+		}
+		if len(mt.Files) != 2 {
+			t.Fatalf("table %s: expected 2 files, got %d", mt.Table, len(mt.Files))
+		}
+		for _, f := range mt.Files {
+			h, sz, err := hashFile(filepath.Join(outA, f.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Sha256 != h || f.Size != sz {
+				t.Errorf("%s: manifest lists %s/%d, actual file is %s/%d", f.Name, f.Sha256, f.Size, h, sz)
+			}
+		}
+
+		// header plus one record per row
+		if recs := readCsvGz(t, filepath.Join(outA, mt.Table+".csv.gz")); int64(len(recs)) != mt.Rows+1 {
+			t.Errorf("%s.csv.gz: expected %d records, got %d", mt.Table, mt.Rows+1, len(recs))
+		}
+	}
+
+	if got, exp := readCsvGz(t, filepath.Join(outA, "deals.csv.gz")), [][]string{
+		{"deal_id", "client_id", "provider_id", "piece_cid", "label", "piece_size", "is_filplus", "price_per_epoch", "provider_collateral", "client_collateral", "start_epoch", "end_epoch", "sector_activation_epoch", "deal_slash_epoch"},
+		{"3", "101", "300", "bafypiece3", "a label", "1024", "false", "0", "1", "2", "500", "800", "450", "700"},
+		{"7", "100", "300", "bafypiece7", "0xff0042", "2048", "true", "3", "4", "5", "600", "900", "", ""},
+	}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("deals.csv.gz:\n got: %q\nwant: %q", got, exp)
+	}
+	if got, exp := readCsvGz(t, filepath.Join(outA, "votes.csv.gz")), [][]string{
+		{"actor_id", "does_accept", "vote_received_ms"},
+		{"100", "true", ""},
+		{"101", "false", "1663675200250"},
+	}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("votes.csv.gz:\n got: %q\nwant: %q", got, exp)
+	}
+}
@@ -0,0 +1,159 @@
+// main is main is main
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// The canonical file stays untouched ( and thus sha256-comparable ): indexes
+// and views go into a copy of it
+const (
+	defaultDb  = `data/filstate_2162760.sqlite`
+	defaultOut = `data/filstate_2162760_indexed.sqlite`
+)
+
+type ddl struct {
+	// statement is skipped unless all these tables exist ( e.g. votes only appear after updatevotes )
+	needsTables []string
+	sql         string
+}
+
+var indexes = []ddl{
+	{[]string{"deals"}, `CREATE INDEX IF NOT EXISTS deals_provider_id_idx ON deals ( provider_id )`},
+	{[]string{"deals"}, `CREATE INDEX IF NOT EXISTS deals_client_id_idx ON deals ( client_id )`},
+	{[]string{"msig_actors"}, `CREATE INDEX IF NOT EXISTS msig_actors_actor_id_idx ON msig_actors ( actor_id )`},
+	{[]string{"votes"}, `CREATE INDEX IF NOT EXISTS votes_actor_id_idx ON votes ( actor_id )`},
+}
+
+var views = []ddl{
+	// the deals the tally counts with its default rules
+	{[]string{"deals"}, `
+		CREATE VIEW IF NOT EXISTS active_deals AS
+			SELECT d.*
+				FROM deals d
+			WHERE ` + tally.DefaultRules.DealCond() + `
+	`},
+	{[]string{"providers", "accounts", "msigs"}, `
+		CREATE VIEW IF NOT EXISTS actor_balances AS
+			SELECT provider_id AS actor_id, 'provider' AS actor_type, balance FROM providers
+				UNION ALL
+			SELECT account_id, 'account', balance FROM accounts
+				UNION ALL
+			SELECT msig_id, 'msig', balance FROM msigs
+	`},
+}
+
+func main() {
+	dbFn := flag.String("db", defaultDb, "canonical state database, never modified")
+	outFn := flag.String("out", defaultOut, "indexed copy to create ( replaced if it exists )")
+	flag.Parse()
+
+	if err := finalizeIndexes(*dbFn, *outFn); err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
+
+func finalizeIndexes(dbFn, outFn string) error {
+	if abs, _ := filepath.Abs(dbFn); abs != "" {
+		if absOut, _ := filepath.Abs(outFn); absOut == abs {
+			return xerrors.Errorf("refusing to add indexes to the canonical %s in place", dbFn)
+		}
+	}
+
+	src, err := os.Open(dbFn)
+	if err != nil {
+		return xerrors.Errorf("unable to open %s: %w", dbFn, err)
+	}
+	defer src.Close() //nolint:errcheck
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(outFn), `.filstate_indexed_*`)
+	if err != nil {
+		return xerrors.Errorf("unable to create temporary sqlite file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) //nolint:errcheck
+
+	if _, err := io.Copy(tmpFile, src); err != nil {
+		tmpFile.Close() //nolint:errcheck
+		return xerrors.Errorf("unable to copy %s: %w", dbFn, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(
+		"sqlite3", tmpFile.Name()+"?"+strings.Join([]string{
+			"mode=rw",
+			"_timeout=5000",
+			"_journal=memory",
+			"_sync=off",
+		}, "&"),
+	)
+	if err != nil {
+		return xerrors.Errorf("failed to open database copy: %w", err)
+	}
+	defer func() {
+		if db != nil {
+			db.Close() //nolint:errcheck
+		}
+	}()
+
+	tables := make(map[string]bool)
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			rows.Close() //nolint:errcheck
+			return err
+		}
+		tables[t] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range append(append([]ddl{}, indexes...), views...) {
+		var missing []string
+		for _, t := range s.needsTables {
+			if !tables[t] {
+				missing = append(missing, t)
+			}
+		}
+		if len(missing) > 0 {
+			log.Printf("table(s) %s not present, skipping: %s", strings.Join(missing, ", "), strings.Join(strings.Fields(s.sql), " "))
+			continue
+		}
+		if _, err := db.Exec(s.sql); err != nil {
+			return xerrors.Errorf("failed executing %s: %w", strings.Join(strings.Fields(s.sql), " "), err)
+		}
+	}
+
+	if _, err := db.Exec(`ANALYZE`); err != nil {
+		return xerrors.Errorf("analyze failed: %w", err)
+	}
+
+	err = db.Close()
+	db = nil
+	if err != nil {
+		return xerrors.Errorf("failure flushing DB at close(): %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), outFn); err != nil {
+		return err
+	}
+
+	log.Printf("Indexed copy of %s written to %s", dbFn, outFn)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+func writeDB(t *testing.T, fn string, stmts ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+}
+
+func sha(t *testing.T, fn string) string {
+	t.Helper()
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func schemaObjects(t *testing.T, fn string) []string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fn+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	rows, err := db.Query(`SELECT type || ':' || name FROM sqlite_master WHERE type IN ( 'index', 'view' ) AND name NOT LIKE 'sqlite_%' ORDER BY 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close() //nolint:errcheck
+	var objs []string
+	for rows.Next() {
+		var o string
+		if err := rows.Scan(&o); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, o)
+	}
+	return objs
+}
+
+var stateSchema = []string{
+	`CREATE TABLE deals ( deal_id BIGINT, client_id INTEGER, provider_id INTEGER, piece_size BIGINT, end_epoch INTEGER, sector_activation_epoch INTEGER, deal_slash_epoch INTEGER )`,
+	`CREATE TABLE providers ( provider_id INTEGER, balance TEXT )`,
+	`CREATE TABLE accounts ( account_id INTEGER, balance TEXT )`,
+	`CREATE TABLE msig_actors ( msig_id INTEGER, actor_id INTEGER )`,
+}
+
+func TestFinalizeIndexes(t *testing.T) {
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "filstate.sqlite")
+	indexed := filepath.Join(dir, "filstate_indexed.sqlite")
+
+	// no msigs table: actor_balances can not be created
+	writeDB(t, canonical, append(stateSchema,
+		`INSERT INTO deals VALUES
+			( 1, 100, 300, 10, 2162761, 5, NULL ),
+			( 2, 100, 300, 20, 2162760, 5, NULL ),
+			( 3, 100, 300, 40, 2162761, 5, 6 ),
+			( 4, 100, 300, 80, 2162761, NULL, NULL )`,
+	)...)
+
+	before := sha(t, canonical)
+	if err := finalizeIndexes(canonical, indexed); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if after := sha(t, canonical); after != before {
+		t.Fatalf("canonical file modified: sha256 %s before, %s after", before, after)
+	}
+	if err := finalizeIndexes(canonical, canonical); err == nil || !strings.Contains(err.Error(), "in place") {
+		t.Fatalf("expected a refusal to index in place, got %v", err)
+	}
+	if after := sha(t, canonical); after != before {
+		t.Fatalf("canonical file modified by the refused in-place run")
+	}
+
+	if got, exp := schemaObjects(t, indexed), []string{
+		"index:deals_client_id_idx",
+		"index:deals_provider_id_idx",
+		"index:msig_actors_actor_id_idx",
+		"view:active_deals",
+	}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("objects in indexed copy:\n got: %v\nwant: %v", got, exp)
+	}
+
+	// the view selects exactly the deals the tally counts
+	db, err := sql.Open("sqlite3", indexed+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+	var viewSum, tallySum int64
+	if err := db.QueryRow(`SELECT SUM( piece_size ) FROM active_deals`).Scan(&viewSum); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT SUM( piece_size ) FROM deals d WHERE ` + tally.DefaultRules.DealCond()).Scan(&tallySum); err != nil {
+		t.Fatal(err)
+	}
+	if viewSum != 10 || tallySum != viewSum {
+		t.Errorf("active_deals piece_size sum %d, tally condition %d, expected 10", viewSum, tallySum)
+	}
+
+	// with every table present the balances view appears as well
+	full := filepath.Join(dir, "full.sqlite")
+	writeDB(t, full, append(stateSchema, `CREATE TABLE msigs ( msig_id INTEGER, balance TEXT )`)...)
+	fullIndexed := filepath.Join(dir, "full_indexed.sqlite")
+	if err := finalizeIndexes(full, fullIndexed); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, exp := schemaObjects(t, fullIndexed), []string{
+		"index:deals_client_id_idx",
+		"index:deals_provider_id_idx",
+		"index:msig_actors_actor_id_idx",
+		"view:active_deals",
+		"view:actor_balances",
+	}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("objects in indexed copy of a complete DB:\n got: %v\nwant: %v", got, exp)
+	}
+}
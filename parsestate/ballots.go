@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filexit "github.com/filecoin-project/go-state-types/exitcode"
+	lchstate "github.com/filecoin-project/lotus/chain/state"
+	lchstore "github.com/filecoin-project/lotus/chain/store"
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// chainBallot is a record of the versioned ballot document: the fields of the
+// FilPoll ballot JSON, plus provenance
+type chainBallot struct {
+	OptionID      uint64
+	SignerAddress filaddr.Address
+	CreatedAt     time.Time
+	Height        filabi.ChainEpoch
+	Message       string
+}
+
+// scanBallots walks the chain backwards from the poll tipset, and turns every
+// successfully executed message to one of the designated vote addresses into
+// a ballot of its sender. The result can be fed to updatevotes -ballots.
+func scanBallots(ctx context.Context, opts parseOpts, args []string) error {
+	fs := flag.NewFlagSet("ballots", flag.ExitOnError)
+	yeaAddr := fs.String("yea-address", "", "messages to this address are ACCEPT ballots ( required )")
+	nayAddr := fs.String("nay-address", "", "messages to this address are REJECT ballots ( required )")
+	method := fs.Uint64("method", 0, "only messages invoking this method number count ( 0: plain sends )")
+	fromEpoch := fs.Int64("from-epoch", 0, "oldest epoch to scan, the snapshot must contain messages and state back to it")
+	outFile := fs.String("out", path.Join(workDir, "chain_ballots_2162760.json"), "where to write the ballot JSON")
+	fs.Parse(args) //nolint:errcheck
+
+	if *yeaAddr == "" || *nayAddr == "" {
+		return xerrors.New("both -yea-address and -nay-address are required")
+	}
+	if *fromEpoch <= 0 {
+		return xerrors.New("-from-epoch is required: the start of the voting period")
+	}
+
+	ebs, closeSrc, err := openSource(ctx, workDir, srcSnapsshot, opts)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+
+	sm, err := newFilStateReader(ebs)
+	if err != nil {
+		return xerrors.Errorf("unable to initialize a StateManager: %w", err)
+	}
+	cs := sm.ChainStore()
+
+	head, err := cs.GetTipSetFromKey(ctx, pollTSK)
+	if err != nil {
+		return xerrors.Errorf("unable to load target tipset: %w", err)
+	}
+
+	// everything is resolved to IDs as of the poll, the same way the state tables are
+	st, err := lchstate.LoadStateTree(ipldcbor.NewCborStore(ebs), head.ParentState())
+	if err != nil {
+		return xerrors.Errorf("unable to load poll state tree: %w", err)
+	}
+	options := make(map[filaddr.Address]uint64, 2)
+	for a, opt := range map[string]uint64{*yeaAddr: tally.OptionYea, *nayAddr: tally.OptionNay} {
+		addr, err := filaddr.NewFromString(a)
+		if err != nil {
+			return xerrors.Errorf("invalid vote address '%s': %w", a, err)
+		}
+		id, err := st.LookupID(addr)
+		if err != nil {
+			return xerrors.Errorf("vote address %s does not exist as of the poll: %w", addr, err)
+		}
+		options[id] = opt
+	}
+	if len(options) != 2 {
+		return xerrors.New("-yea-address and -nay-address resolve to the same actor")
+	}
+
+	ballots, err := chainBallots(ctx, cs, st, head, filabi.ChainEpoch(*fromEpoch), options, filabi.MethodNum(*method))
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(*outFile)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Version int
+		Ballots []chainBallot
+	}{tally.BallotSchemaVersion, ballots}); err != nil {
+		out.Close() //nolint:errcheck
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("wrote %d on-chain ballots cast between epochs %d and %d to %s", len(ballots), *fromEpoch, head.Height()-1, *outFile)
+	return nil
+}
+
+// chainBallots returns the ballots in chain order. Messages of the head
+// tipset itself are not considered: their receipts are not yet part of it.
+func chainBallots(ctx context.Context, cs *lchstore.ChainStore, st *lchstate.StateTree, head *lchtypes.TipSet, fromEpoch filabi.ChainEpoch, options map[filaddr.Address]uint64, method filabi.MethodNum) ([]chainBallot, error) {
+
+	ballots := make([]chainBallot, 0, 1<<10)
+
+	for child := head; child.Height() > fromEpoch; {
+		ts, err := cs.LoadTipSet(ctx, child.Parents())
+		if err != nil {
+			return nil, xerrors.Errorf("unable to load tipset at height below %d, is -from-epoch within the snapshot? %w", child.Height(), err)
+		}
+		if ts.Height() < fromEpoch {
+			break
+		}
+
+		// receipts of the parent tipset are in the child, in the same order
+		msgs, err := cs.MessagesForTipset(ctx, ts)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to load messages of tipset at height %d, is -from-epoch within the snapshot? %w", ts.Height(), err)
+		}
+
+		// walking backwards: collect per tipset and prepend
+		var tsBallots []chainBallot
+		for i, cm := range msgs {
+			m := cm.VMMessage()
+			if m.Method != method {
+				continue
+			}
+			to, err := st.LookupID(m.To)
+			if err != nil {
+				continue
+			}
+			opt, isBallot := options[to]
+			if !isBallot {
+				continue
+			}
+
+			rcpt, err := cs.GetParentReceipt(ctx, child.Blocks()[0], i)
+			if err != nil {
+				return nil, xerrors.Errorf("unable to load receipt of %s: %w", cm.Cid(), err)
+			}
+			if rcpt.ExitCode != filexit.Ok {
+				log.Printf("ignoring failed ballot %s at height %d: exit code %d", cm.Cid(), ts.Height(), rcpt.ExitCode)
+				continue
+			}
+
+			from, err := st.LookupID(m.From)
+			if err != nil {
+				return nil, xerrors.Errorf("sender %s of ballot %s does not exist as of the poll: %w", m.From, cm.Cid(), err)
+			}
+
+			tsBallots = append(tsBallots, chainBallot{
+				OptionID:      opt,
+				SignerAddress: from,
+				CreatedAt:     time.Unix(int64(ts.MinTimestamp()), 0).UTC(),
+				Height:        ts.Height(),
+				Message:       cm.Cid().String(),
+			})
+		}
+		ballots = append(tsBallots, ballots...)
+
+		child = ts
+	}
+
+	return ballots, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filexit "github.com/filecoin-project/go-state-types/exitcode"
+	lchstate "github.com/filecoin-project/lotus/chain/state"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+func TestChainBallots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// 300 and 301 stand in for the designated vote addresses
+	fs := smallState
+	fs.messages = []fixtureMessage{
+		{from: 100, to: 300},
+		{from: 101, to: 301},
+		{from: 102, to: 300, method: 2}, // wrong method
+		{from: 103, to: 300, exitCode: filexit.ErrInsufficientFunds}, // failed
+		{from: 100, to: 301}, // later conflicting, updatevotes ignores it
+		{from: 102, to: 200}, // not a vote address
+	}
+	tsk := writeFixtureCar(t, dir, "fixture.car", fs)
+
+	ebs, closeSrc, err := openSource(ctx, dir, "fixture.car", parseOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSrc()
+	sm, err := newFilStateReader(ebs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := sm.ChainStore().GetTipSetFromKey(ctx, tsk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := lchstate.LoadStateTree(ipldcbor.NewCborStore(ebs), head.ParentState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ballots, err := chainBallots(ctx, sm.ChainStore(), st, head, fixtureHeight-1, map[filaddr.Address]uint64{
+		idAddr(300): tally.OptionYea,
+		idAddr(301): tally.OptionNay,
+	}, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	type got struct {
+		option uint64
+		signer filaddr.Address
+		height filabi.ChainEpoch
+	}
+	var gots []got
+	for _, b := range ballots {
+		gots = append(gots, got{b.OptionID, b.SignerAddress, b.Height})
+		if b.CreatedAt.Unix() != 1663000000 {
+			t.Errorf("ballot %s: unexpected timestamp %s", b.Message, b.CreatedAt)
+		}
+	}
+	want := []got{
+		{tally.OptionYea, idAddr(100), fixtureHeight - 1},
+		{tally.OptionNay, idAddr(101), fixtureHeight - 1},
+		{tally.OptionNay, idAddr(100), fixtureHeight - 1},
+	}
+	if !reflect.DeepEqual(gots, want) {
+		t.Errorf("\n got: %v\nwant: %v", gots, want)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// checkpoint rows travel along with the data rows of a walker, and are
+// committed in the same transaction: whatever is in the tables always
+// corresponds exactly to the last recorded position of each walker
+const procCheckpoint = procID(-1)
+
+const (
+	walkerDeals  = "deals"
+	walkerActors = "actors"
+)
+
+// checkpoint is a walker position: the last deal ID for deals, the shard and
+// ordinal of the last visited actor within that shard for actors
+type checkpoint struct {
+	major int64
+	minor int64
+}
+
+type checkpoints map[string]checkpoint
+
+func checkpointRow(walker string, major, minor int64) dbRow {
+	return dbRow{procCheckpoint, []interface{}{walker, major, minor}}
+}
+
+// both tables are dropped before the final VACUUM, they never end up in a finished database
+var checkpointSchema = []string{
+	`
+	CREATE TABLE checkpoint_run (
+		params TEXT NOT NULL
+	)
+	`,
+	`
+	CREATE TABLE checkpoints (
+		walker TEXT NOT NULL UNIQUE,
+		major BIGINT NOT NULL,
+		minor BIGINT NOT NULL
+	)
+	`,
+}
+
+const checkpointSQL = `INSERT OR REPLACE INTO checkpoints ( walker, major, minor ) VALUES ( $1, $2, $3 )`
+
+// readCheckpoints returns the positions recorded in a partial database left
+// behind by an earlier run, nil if there is nothing to resume
+func readCheckpoints(partialFile, runParams string) (checkpoints, error) {
+	if _, err := os.Stat(partialFile); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", partialFile+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close() //nolint:errcheck
+
+	var params string
+	if err := db.QueryRow(`SELECT params FROM checkpoint_run`).Scan(&params); err != nil {
+		return nil, xerrors.Errorf("no usable checkpoint information: %w", err)
+	}
+	if params != runParams {
+		return nil, xerrors.Errorf("left behind by a run with different parameters ( %s )", params)
+	}
+
+	rows, err := db.Query(`SELECT walker, major, minor FROM checkpoints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	ckpts := make(checkpoints)
+	for rows.Next() {
+		var w string
+		var c checkpoint
+		if err := rows.Scan(&w, &c.major, &c.minor); err != nil {
+			return nil, err
+		}
+		ckpts[w] = c
+	}
+	return ckpts, rows.Err()
+}
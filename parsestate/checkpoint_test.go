@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", smallState)
+	opts := parseOpts{workers: 2, backend: "sqlite"}
+
+	refFile := filepath.Join(dir, "ref.sqlite")
+	refOpts := opts
+	refOpts.outFile = refFile
+	if err := parseStaticData(context.Background(), dir, "fixture.car", tsk, refOpts); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// a commit per batch of rows, and an abort right after the first one
+	defer func(orig int) { writeTxRows, afterCommit = orig, nil }(writeTxRows)
+	writeTxRows = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	afterCommit = func(txs int64) {
+		if txs == 1 {
+			cancel()
+		}
+	}
+
+	outFile := filepath.Join(dir, "out.sqlite")
+	partialFile := filepath.Join(dir, ".out.sqlite.partial")
+	opts.outFile = outFile
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, opts); err == nil {
+		t.Fatal("expected the interrupted run to fail")
+	}
+	if _, err := os.Stat(outFile); !os.IsNotExist(err) {
+		t.Fatalf("interrupted run produced %s", outFile)
+	}
+	ckpts, err := readCheckpoints(partialFile, "fixture.car@"+tsk.String())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(ckpts) == 0 {
+		t.Fatal("no checkpoint recorded by the interrupted run")
+	}
+
+	afterCommit = nil
+	if err := parseStaticData(context.Background(), dir, "fixture.car", tsk, opts); err != nil {
+		t.Fatalf("resuming: %+v", err)
+	}
+	if _, err := os.Stat(partialFile); !os.IsNotExist(err) {
+		t.Errorf("partial file still present after a successful resume")
+	}
+
+	if sha, err := fileSha256(outFile); err != nil {
+		t.Fatal(err)
+	} else if sha != smallStateSha256 {
+		t.Errorf("sha256 of the resumed result: got %s, want %s", sha, smallStateSha256)
+	}
+	refDg, err := storedDigests(context.Background(), refFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dg, err := storedDigests(context.Background(), outFile); err != nil {
+		t.Fatal(err)
+	} else if digestReport(dg) != digestReport(refDg) {
+		t.Errorf("table digests of the resumed result:%s\nwant:%s", digestReport(dg), digestReport(refDg))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+type tableDigest struct {
+	rows   int64
+	sha256 []byte
+}
+
+func (d tableDigest) String() string {
+	return fmt.Sprintf("rows:% 9d     sha256:%x", d.rows, d.sha256)
+}
+
+// allTables lists the tables produced by parsestate, in procID order
+func allTables() []string {
+	ts := make([]string, 0, len(procTables))
+	for id := procID(0); int(id) < len(procTables); id++ {
+		ts = append(ts, procTables[id].table)
+	}
+	return ts
+}
+
+func tableDefByName(name string) (tableDef, bool) {
+	for _, t := range procTables {
+		if t.table == name {
+			return t, true
+		}
+	}
+	return tableDef{}, false
+}
+
+// digestsTable is stored in every generated SQLite file, it is not digested itself
+const digestsTable = "table_digests"
+
+func fileTableDigests(ctx context.Context, dbFile string, tables []string) (map[string]tableDigest, error) {
+	db, err := sql.Open("sqlite3", dbFile+"?mode=ro")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %s: %w", dbFile, err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	return tableDigests(ctx, db, tables)
+}
+
+// tableDigests hashes every row of every requested table, ordered by all its
+// columns. Each value is type-tagged and length-prefixed, with TEXT and BLOB
+// ( and likewise BOOLEAN and INTEGER ) treated the same, so the digest only
+// depends on the data and not on how a particular driver chose to store it.
+func tableDigests(ctx context.Context, db *sql.DB, tables []string) (map[string]tableDigest, error) {
+	res := make(map[string]tableDigest, len(tables))
+	for _, tn := range tables {
+		t, known := tableDefByName(tn)
+		if !known {
+			return nil, xerrors.Errorf("unknown table '%s'", tn)
+		}
+
+		ord := make([]string, len(t.columns))
+		for i := range ord {
+			ord[i] = strconv.Itoa(i + 1)
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(
+			"SELECT %s FROM %s ORDER BY %s",
+			strings.Join(t.columns, ", "),
+			t.table,
+			strings.Join(ord, ", "),
+		))
+		if err != nil {
+			return nil, xerrors.Errorf("unable to read table %s: %w", t.table, err)
+		}
+
+		h := sha256.New()
+		var d tableDigest
+		vals := make([]interface{}, len(t.columns))
+		ptrs := make([]interface{}, len(t.columns))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close() //nolint:errcheck
+				return nil, err
+			}
+			for _, v := range vals {
+				if err := writeCanonical(h, v); err != nil {
+					rows.Close() //nolint:errcheck
+					return nil, xerrors.Errorf("table %s: %w", t.table, err)
+				}
+			}
+			d.rows++
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		d.sha256 = h.Sum(nil)
+		res[t.table] = d
+	}
+
+	return res, nil
+}
+
+// storeDigests records the content digests of all tables in the database itself,
+// so that two copies can be compared regardless of the SQLite build that made them
+func storeDigests(ctx context.Context, db *sql.DB, dg map[string]tableDigest) error {
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS ` + digestsTable,
+		`
+		CREATE TABLE ` + digestsTable + ` (
+			table_name TEXT NOT NULL UNIQUE,
+			row_count BIGINT NOT NULL,
+			sha256 TEXT NOT NULL
+		)
+		`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			return xerrors.Errorf("unable to create digests table: %w", err)
+		}
+	}
+	for _, t := range allTables() {
+		if _, err := db.ExecContext(
+			ctx,
+			`INSERT INTO `+digestsTable+` ( table_name, row_count, sha256 ) VALUES ( $1, $2, $3 )`,
+			t, dg[t].rows, hex.EncodeToString(dg[t].sha256),
+		); err != nil {
+			return xerrors.Errorf("unable to record digest of %s: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// storedDigests reads back what storeDigests recorded in dbFile
+func storedDigests(ctx context.Context, dbFile string) (map[string]tableDigest, error) {
+	db, err := sql.Open("sqlite3", dbFile+"?mode=ro")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %s: %w", dbFile, err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	rows, err := db.QueryContext(ctx, `SELECT table_name, row_count, sha256 FROM `+digestsTable)
+	if err != nil {
+		return nil, xerrors.Errorf("no usable %s table in %s: %w", digestsTable, dbFile, err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	dg := make(map[string]tableDigest)
+	for rows.Next() {
+		var t, h string
+		var d tableDigest
+		if err := rows.Scan(&t, &d.rows, &h); err != nil {
+			return nil, err
+		}
+		if d.sha256, err = hex.DecodeString(h); err != nil {
+			return nil, xerrors.Errorf("invalid digest of %s: %w", t, err)
+		}
+		dg[t] = d
+	}
+	return dg, rows.Err()
+}
+
+// strippedSha256 is the sha256 dbFile would have without the digests table,
+// computed on a temporary copy finalized just like the original. This is what
+// the published sha256, which predates the digests table, covers.
+func strippedSha256(dbFile string) (string, error) {
+	src, err := os.Open(dbFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close() //nolint:errcheck
+
+	tmp, err := os.CreateTemp(filepath.Dir(dbFile), "."+filepath.Base(dbFile)+".stripped-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) //nolint:errcheck
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close() //nolint:errcheck
+		return "", xerrors.Errorf("unable to copy %s: %w", dbFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	db, err := sql.Open("sqlite3", tmpName+"?_journal=memory&_vacuum=none")
+	if err != nil {
+		return "", err
+	}
+	for _, s := range []string{`DROP TABLE IF EXISTS ` + digestsTable, `VACUUM`} {
+		if _, err := db.Exec(s); err != nil {
+			db.Close() //nolint:errcheck
+			return "", xerrors.Errorf("unable to strip the digests of %s: %w", dbFile, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		return "", err
+	}
+	if err := resetHeader(tmpName); err != nil {
+		return "", err
+	}
+
+	return fileSha256(tmpName)
+}
+
+func digestReport(dg map[string]tableDigest) string {
+	var report strings.Builder
+	for _, t := range allTables() {
+		if d, present := dg[t]; present {
+			fmt.Fprintf(&report, "\n% 12s  %s", t, d)
+		}
+	}
+	return report.String()
+}
+
+func writeCanonical(w io.Writer, v interface{}) error {
+	var tag byte
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		tag = 'N'
+	case int64:
+		tag, b = 'I', strconv.AppendInt(nil, v, 10)
+	case bool:
+		tag, b = 'I', []byte{'0'}
+		if v {
+			b[0] = '1'
+		}
+	case string:
+		tag, b = 'S', []byte(v)
+	case []byte:
+		tag, b = 'S', v
+	case time.Time:
+		tag, b = 'S', []byte(v.UTC().Format(time.RFC3339Nano))
+	default:
+		return xerrors.Errorf("value %#v of type %T has no canonical encoding", v, v)
+	}
+	_, err := fmt.Fprintf(w, "%c%d:%s", tag, len(b), b)
+	return err
+}
+
+func fileSha256(fn string) (string, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", xerrors.Errorf("unable to read %s: %w", fn, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteCanonical(t *testing.T) {
+	var buf bytes.Buffer
+	for _, v := range []interface{}{nil, int64(-42), true, false, "ab|c", []byte{0xff, 0}} {
+		if err := writeCanonical(&buf, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exp := "N0:I3:-42I1:1I1:0S4:ab|cS2:\xff\x00"; buf.String() != exp {
+		t.Fatalf("canonical encoding: got %q, want %q", buf.String(), exp)
+	}
+	if err := writeCanonical(&buf, 4.2); err == nil {
+		t.Fatal("expected floats to have no canonical encoding")
+	}
+}
+
+func TestTableDigests(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// the same deals, stored in different order and with different value types
+	mkDB := func(name string, rows ...string) *sql.DB {
+		t.Helper()
+		db, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() }) //nolint:errcheck
+		for _, s := range append(schemaSQL(false), rows...) {
+			if _, err := db.Exec(s); err != nil {
+				t.Fatalf("%s: %s", s, err)
+			}
+		}
+		return db
+	}
+	a := mkDB("a.sqlite",
+		`INSERT INTO deals VALUES ( 1, 100, 300, 'bafy1', 'lbl', 2048, 1, 0, 1, 2, 10, 20, 5, NULL )`,
+		`INSERT INTO deals VALUES ( 2, 101, 300, 'bafy2', '', 4096, 0, 0, 1, 2, 10, 20, NULL, NULL )`,
+	)
+	b := mkDB("b.sqlite",
+		`INSERT INTO deals VALUES ( 2, 101, 300, 'bafy2', X'', 4096, false, 0, 1, 2, 10, 20, NULL, NULL )`,
+		`INSERT INTO deals VALUES ( 1, 100, 300, 'bafy1', X'6c626c', 2048, true, 0, 1, 2, 10, 20, 5, NULL )`,
+	)
+	c := mkDB("c.sqlite",
+		`INSERT INTO deals VALUES ( 1, 100, 300, 'bafy1', 'lbl', 2048, 1, 0, 1, 2, 10, 20, 5, NULL )`,
+		`INSERT INTO deals VALUES ( 2, 101, 300, 'bafy2', '', 4096, 0, 0, 1, 2, 10, 20, 6, NULL )`,
+	)
+
+	dg := func(db *sql.DB) tableDigest {
+		t.Helper()
+		d, err := tableDigests(ctx, db, []string{"deals"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d["deals"]
+	}
+	if da, db := dg(a), dg(b); da.String() != db.String() || da.rows != 2 {
+		t.Errorf("same content, different digests:\n%s\n%s", da, db)
+	}
+	if da, dc := dg(a), dg(c); da.String() == dc.String() {
+		t.Error("different content, same digest")
+	}
+
+	if _, err := tableDigests(ctx, a, []string{"votes"}); err == nil {
+		t.Error("expected an unknown table to be refused")
+	}
+}
+
+func TestStoredDigests(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", smallState)
+
+	outFile := filepath.Join(dir, "out.sqlite")
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, parseOpts{workers: 1, backend: "sqlite", outFile: outFile}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	dg, err := fileTableDigests(ctx, outFile, allTables())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := storedDigests(ctx, outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(dg) {
+		t.Errorf("stored digests of %d tables, want %d", len(stored), len(dg))
+	}
+	for _, tbl := range allTables() {
+		if stored[tbl].String() != dg[tbl].String() || stored[tbl].rows != int64(len(smallStateRows[tbl])) {
+			t.Errorf("stored digest of %s: got %s, want %s", tbl, stored[tbl], dg[tbl])
+		}
+	}
+
+	// the state tables and their digests, nothing of the run itself
+	db, err := sql.Open("sqlite3", outFile+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+	if tables := dumpTable(t, db, tableDef{table: "sqlite_master WHERE type = 'table'", columns: []string{"name"}}); !reflect.DeepEqual(tables, []string{"accounts", "deals", "msig_actors", "msigs", "providers", digestsTable}) {
+		t.Errorf("unexpected tables in the database: %v", tables)
+	}
+}
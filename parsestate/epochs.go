@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"golang.org/x/xerrors"
+)
+
+func runEpochs(ctx context.Context, epochSpec, headSpec string, opts parseOpts) error {
+	if opts.expectSha256 != "" {
+		return xerrors.New("-expect-sha256 is only meaningful for the single poll tipset dump")
+	}
+	epochs, err := parseEpochList(epochSpec)
+	if err != nil {
+		return err
+	}
+	head, err := headTipSetKey(workDir, srcSnapsshot, headSpec)
+	if err != nil {
+		return err
+	}
+	return parseEpochs(ctx, workDir, srcSnapsshot, head, epochs, opts)
+}
+
+// parseEpochList turns e.g. "2162000,2162300-2163000/120" into a sorted list
+// of distinct epochs, the latter form being every 120th epoch from 2162300
+// up to and including 2163000
+func parseEpochList(spec string) ([]filabi.ChainEpoch, error) {
+	seen := make(map[filabi.ChainEpoch]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		fromStr, toStr, isRange := strings.Cut(rng, "-")
+		if !isRange {
+			toStr = fromStr
+		}
+
+		from, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil || from <= 0 {
+			return nil, xerrors.Errorf("invalid epoch in '%s'", item)
+		}
+		to, err := strconv.ParseInt(toStr, 10, 64)
+		if err != nil || to < from {
+			return nil, xerrors.Errorf("invalid epoch range '%s'", item)
+		}
+		step := int64(1)
+		if hasStep {
+			if step, err = strconv.ParseInt(stepStr, 10, 64); err != nil || step <= 0 || !isRange {
+				return nil, xerrors.Errorf("invalid step in '%s'", item)
+			}
+		} else if isRange && to > from {
+			return nil, xerrors.Errorf("range '%s' lacks a /step", item)
+		}
+
+		for e := from; e <= to; e += step {
+			seen[filabi.ChainEpoch(e)] = true
+		}
+	}
+
+	epochs := make([]filabi.ChainEpoch, 0, len(seen))
+	for e := range seen {
+		epochs = append(epochs, e)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs, nil
+}
+
+// headTipSetKey is the poll tipset for "", the root of the snapshot car for
+// "snapshot", and a comma-separated list of block CIDs otherwise
+func headTipSetKey(workDir, srcSnapshot, spec string) (lchtypes.TipSetKey, error) {
+	switch spec {
+	case "":
+		return pollTSK, nil
+	case "snapshot":
+		fh, err := os.Open(path.Join(workDir, srcSnapshot))
+		if err != nil {
+			return lchtypes.EmptyTSK, xerrors.Errorf("unable to open snapshot: %w", err)
+		}
+		defer fh.Close() //nolint:errcheck
+		cr, err := car.NewReader(fh)
+		if err != nil {
+			return lchtypes.EmptyTSK, xerrors.Errorf("unable to read snapshot header: %w", err)
+		}
+		roots, err := cr.Roots()
+		if err != nil {
+			return lchtypes.EmptyTSK, xerrors.Errorf("unable to read snapshot roots: %w", err)
+		}
+		return lchtypes.NewTipSetKey(roots...), nil
+	}
+
+	var cids []cid.Cid
+	for _, s := range strings.Split(spec, ",") {
+		c, err := cid.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return lchtypes.EmptyTSK, xerrors.Errorf("invalid block CID '%s': %w", s, err)
+		}
+		cids = append(cids, c)
+	}
+	return lchtypes.NewTipSetKey(cids...), nil
+}
+
+// parseEpochs dumps the state as of every epoch into its own database, e.g.
+// data/filstate_2162760.sqlite or the postgres schema filstate_2162760. All
+// epochs are read through the same source blockstore and read cache: blocks
+// shared between them are fetched once. An epoch without a tipset ( a null
+// round ) is dumped as of the closest preceding tipset, and named after it.
+func parseEpochs(ctx context.Context, workDir, srcSnapshot string, head lchtypes.TipSetKey, epochs []filabi.ChainEpoch, opts parseOpts) error {
+
+	ebs, closeSrc, err := openSource(ctx, workDir, srcSnapshot, opts)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+
+	sm, err := newFilStateReader(ebs)
+	if err != nil {
+		return xerrors.Errorf("unable to initialize a StateManager: %w", err)
+	}
+	cs := sm.ChainStore()
+
+	headTs, err := cs.GetTipSetFromKey(ctx, head)
+	if err != nil {
+		return xerrors.Errorf("unable to load head tipset: %w", err)
+	}
+
+	// resolve everything upfront: no point dumping half of the list
+	tipsets := make([]*lchtypes.TipSet, 0, len(epochs))
+	for _, e := range epochs {
+		if e > headTs.Height() {
+			return xerrors.Errorf("epoch %d is past the head at %d, see -head", e, headTs.Height())
+		}
+		ts, err := cs.GetTipsetByHeight(ctx, e, headTs, true)
+		if err != nil {
+			return xerrors.Errorf("unable to find the tipset at epoch %d: %w", e, err)
+		}
+		if ts.Height() != e {
+			log.Printf("epoch %d is a null round, using the tipset at %d instead", e, ts.Height())
+		}
+		if len(tipsets) > 0 && tipsets[len(tipsets)-1].Equals(ts) {
+			continue
+		}
+		tipsets = append(tipsets, ts)
+	}
+
+	for i, ts := range tipsets {
+		epochOpts := opts
+		epochOpts.outFile = path.Join(workDir, fmt.Sprintf("filstate_%d.sqlite", ts.Height()))
+		epochOpts.pgSchema = fmt.Sprintf("filstate_%d", ts.Height())
+		log.Printf("dumping state as of epoch %d ( %d/%d )", ts.Height(), i+1, len(tipsets))
+		if err := dumpTipset(ctx, ebs, sm, ts, srcSnapshot, epochOpts); err != nil {
+			return xerrors.Errorf("epoch %d: %w", ts.Height(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filbig "github.com/filecoin-project/go-state-types/big"
+	filexit "github.com/filecoin-project/go-state-types/exitcode"
+	lactors "github.com/filecoin-project/lotus/chain/actors"
+	lbiaccount "github.com/filecoin-project/lotus/chain/actors/builtin/account"
+	lbimsig "github.com/filecoin-project/lotus/chain/actors/builtin/multisig"
+	lchstate "github.com/filecoin-project/lotus/chain/state"
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	adt0 "github.com/filecoin-project/specs-actors/actors/util/adt"
+	builtin7 "github.com/filecoin-project/specs-actors/v7/actors/builtin"
+	market7 "github.com/filecoin-project/specs-actors/v7/actors/builtin/market"
+	miner7 "github.com/filecoin-project/specs-actors/v7/actors/builtin/miner"
+	power7 "github.com/filecoin-project/specs-actors/v7/actors/builtin/power"
+	adt7 "github.com/filecoin-project/specs-actors/v7/actors/util/adt"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipfsbs "github.com/ipfs/go-ipfs-blockstore"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// height of the head tipset of the synthetic chain
+const fixtureHeight = 1000
+
+type fixtureAccount struct {
+	id      uint64
+	pubkey  string // secp256k1 payload, hashed into the robust address
+	balance int64
+}
+
+type fixtureMsig struct {
+	id        uint64
+	signers   []uint64
+	threshold uint64
+	balance   int64
+	// vesting linearly from epoch 0 over unlock epochs
+	initial int64
+	unlock  filabi.ChainEpoch
+}
+
+type fixtureProvider struct {
+	id, owner, worker uint64
+	balance           int64
+	// no power claim at all when nil
+	raw, qa *int64
+}
+
+type fixtureDeal struct {
+	client, provider        uint64
+	label                   string
+	pieceSize               filabi.PaddedPieceSize
+	verified                bool
+	price, provColl, clColl int64
+	start, end              filabi.ChainEpoch
+	// no deal state at all when activated is -1
+	activated, slashed filabi.ChainEpoch
+}
+
+// a message included in the tipset right below fixtureHeight
+type fixtureMessage struct {
+	from, to uint64
+	method   filabi.MethodNum
+	exitCode filexit.ExitCode
+}
+
+type fixtureState struct {
+	accounts  []fixtureAccount
+	msigs     []fixtureMsig
+	providers []fixtureProvider
+	deals     []fixtureDeal
+	messages  []fixtureMessage
+}
+
+func i64(v int64) *int64 { return &v }
+
+// a bit of everything the walkers care about: accounts, a nested msig with a
+// vesting balance, providers with and without power, and deals in all states
+var smallState = fixtureState{
+	accounts: []fixtureAccount{
+		{100, "alice", 1_000_000},
+		{101, "bob", 2_000_000},
+		{102, "carol", 0},
+		{103, "dave", 42},
+	},
+	msigs: []fixtureMsig{
+		{id: 200, signers: []uint64{100, 101}, threshold: 2, balance: 5_000},
+		{id: 201, signers: []uint64{102, 200, 103}, threshold: 2, balance: 4_000, initial: 4_000, unlock: 4 * fixtureHeight},
+	},
+	providers: []fixtureProvider{
+		{id: 300, owner: 100, worker: 101, balance: 7_000, raw: i64(32 << 30), qa: i64(320 << 30)},
+		{id: 301, owner: 200, worker: 103, balance: 9_000},
+	},
+	deals: []fixtureDeal{
+		{client: 100, provider: 300, label: "bafyactive", pieceSize: 1 << 20, verified: true, price: 0, provColl: 10, clColl: 0, start: 500, end: 2000, activated: 400, slashed: -1},
+		{client: 102, provider: 300, label: "", pieceSize: 2 << 20, price: 7, provColl: 20, clColl: 1, start: 600, end: 900, activated: 550, slashed: -1},
+		{client: 100, provider: 301, label: "slashed", pieceSize: 4 << 20, price: 1, provColl: 30, clColl: 2, start: 700, end: 5000, activated: 650, slashed: 800},
+		{client: 103, provider: 301, label: "pending", pieceSize: 8 << 20, verified: true, price: 3, provColl: 40, clColl: 3, start: 1500, end: 3000, activated: -1},
+	},
+}
+
+func idAddr(id uint64) filaddr.Address {
+	a, err := filaddr.NewIDAddress(id)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func pubkeyAddr(payload string) filaddr.Address {
+	a, err := filaddr.NewSecp256k1Address([]byte(payload))
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// writeFixtureCar serializes the state as a v7 state tree, and writes every
+// block into a CARv2 within dir. The chain consists of two single block
+// tipsets: the returned head, and its parent holding all messages.
+func writeFixtureCar(t *testing.T, dir, carName string, fs fixtureState) lchtypes.TipSetKey {
+	t.Helper()
+	ctx := context.Background()
+
+	mem := ipfsbs.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cst := ipldcbor.NewCborStore(mem)
+	store := adt7.WrapStore(ctx, cst)
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(v interface{}) cid.Cid {
+		t.Helper()
+		c, err := cst.Put(ctx, v)
+		must(err)
+		return c
+	}
+
+	tree, err := lchstate.NewStateTree(cst, lchtypes.StateTreeVersion4)
+	must(err)
+	setActor := func(id uint64, code cid.Cid, head cid.Cid, balance int64) {
+		t.Helper()
+		must(tree.SetActor(idAddr(id), &lchtypes.Actor{Code: code, Head: head, Balance: filbig.NewInt(balance)}))
+	}
+
+	for _, a := range fs.accounts {
+		st, err := lbiaccount.MakeState(store, lactors.Version7, pubkeyAddr(a.pubkey))
+		must(err)
+		setActor(a.id, builtin7.AccountActorCodeID, put(st.GetState()), a.balance)
+	}
+
+	for _, m := range fs.msigs {
+		signers := make([]filaddr.Address, len(m.signers))
+		for i, s := range m.signers {
+			signers[i] = idAddr(s)
+		}
+		st, err := lbimsig.MakeState(store, lactors.Version7, signers, m.threshold, 0, m.unlock, filbig.NewInt(m.initial))
+		must(err)
+		setActor(m.id, builtin7.MultisigActorCodeID, put(st.GetState()), m.balance)
+	}
+
+	pst, err := power7.ConstructState(store)
+	must(err)
+	claims, err := adt7.AsMap(store, pst.Claims, builtin7.DefaultHamtBitwidth)
+	must(err)
+	for _, p := range fs.providers {
+		info, err := miner7.ConstructMinerInfo(idAddr(p.owner), idAddr(p.worker), nil, []byte("peer"), nil, filabi.RegisteredPoStProof_StackedDrgWindow32GiBV1)
+		must(err)
+		mst, err := miner7.ConstructState(store, put(info), 0, 0)
+		must(err)
+		setActor(p.id, builtin7.StorageMinerActorCodeID, put(mst), p.balance)
+
+		if p.raw != nil {
+			must(claims.Put(filabi.AddrKey(idAddr(p.id)), &power7.Claim{
+				WindowPoStProofType: filabi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
+				RawBytePower:        filbig.NewInt(*p.raw),
+				QualityAdjPower:     filbig.NewInt(*p.qa),
+			}))
+		}
+	}
+	pst.Claims, err = claims.Root()
+	must(err)
+	setActor(4, builtin7.StoragePowerActorCodeID, put(pst), 0)
+
+	mkst, err := market7.ConstructState(store)
+	must(err)
+	props, err := adt7.AsArray(store, mkst.Proposals, market7.ProposalsAmtBitwidth)
+	must(err)
+	states, err := adt7.AsArray(store, mkst.States, market7.StatesAmtBitwidth)
+	must(err)
+	for i, d := range fs.deals {
+		pieceCid := put(d.label + "-piece")
+		must(props.Set(uint64(i), &market7.DealProposal{
+			PieceCID:             pieceCid,
+			PieceSize:            d.pieceSize,
+			VerifiedDeal:         d.verified,
+			Client:               idAddr(d.client),
+			Provider:             idAddr(d.provider),
+			Label:                d.label,
+			StartEpoch:           d.start,
+			EndEpoch:             d.end,
+			StoragePricePerEpoch: filbig.NewInt(d.price),
+			ProviderCollateral:   filbig.NewInt(d.provColl),
+			ClientCollateral:     filbig.NewInt(d.clColl),
+		}))
+		if d.activated != -1 {
+			must(states.Set(uint64(i), &market7.DealState{
+				SectorStartEpoch: d.activated,
+				LastUpdatedEpoch: -1,
+				SlashEpoch:       d.slashed,
+			}))
+		}
+	}
+	if mkst.Proposals, err = props.Root(); err != nil {
+		t.Fatal(err)
+	}
+	if mkst.States, err = states.Root(); err != nil {
+		t.Fatal(err)
+	}
+	mkst.NextID = filabi.DealID(len(fs.deals))
+	setActor(5, builtin7.StorageMarketActorCodeID, put(mkst), 0)
+
+	stateRoot, err := tree.Flush(ctx)
+	must(err)
+
+	// block headers use adt0 AMTs, as does the chainstore reading them
+	bstore := adt0.WrapStore(ctx, cst)
+	emptyAmt, err := adt0.MakeEmptyArray(bstore).Root()
+	must(err)
+	msgCids := adt0.MakeEmptyArray(bstore)
+	receipts := adt0.MakeEmptyArray(bstore)
+	nonces := make(map[uint64]uint64)
+	for i, fm := range fs.messages {
+		m := &lchtypes.Message{
+			To:         idAddr(fm.to),
+			From:       idAddr(fm.from),
+			Nonce:      nonces[fm.from],
+			Value:      filbig.Zero(),
+			GasLimit:   1_000_000,
+			GasFeeCap:  filbig.NewInt(100),
+			GasPremium: filbig.NewInt(1),
+			Method:     fm.method,
+		}
+		nonces[fm.from]++
+		must(msgCids.Set(uint64(i), cbg.CborCid(put(m))))
+		must(receipts.Set(uint64(i), &lchtypes.MessageReceipt{ExitCode: fm.exitCode, Return: []byte{}}))
+	}
+	blsRoot, err := msgCids.Root()
+	must(err)
+	rcptRoot, err := receipts.Root()
+	must(err)
+
+	putHeader := func(blk *lchtypes.BlockHeader) cid.Cid {
+		t.Helper()
+		sb, err := blk.ToStorageBlock()
+		must(err)
+		must(mem.Put(ctx, sb))
+		return sb.Cid()
+	}
+	parent := putHeader(&lchtypes.BlockHeader{
+		Miner:                 idAddr(300),
+		ParentWeight:          filbig.Zero(),
+		Height:                fixtureHeight - 1,
+		ParentStateRoot:       stateRoot,
+		ParentMessageReceipts: emptyAmt,
+		Messages:              put(&lchtypes.MsgMeta{BlsMessages: blsRoot, SecpkMessages: emptyAmt}),
+		Timestamp:             1663000000,
+		ParentBaseFee:         filbig.NewInt(100),
+	})
+	head := putHeader(&lchtypes.BlockHeader{
+		Miner:                 idAddr(300),
+		Parents:               []cid.Cid{parent},
+		ParentWeight:          filbig.Zero(),
+		Height:                fixtureHeight,
+		ParentStateRoot:       stateRoot,
+		ParentMessageReceipts: rcptRoot,
+		Messages:              put(&lchtypes.MsgMeta{BlsMessages: emptyAmt, SecpkMessages: emptyAmt}),
+		Timestamp:             1663000030,
+		ParentBaseFee:         filbig.NewInt(100),
+	})
+
+	rw, err := carbs.OpenReadWrite(filepath.Join(dir, carName), []cid.Cid{head})
+	must(err)
+	keys, err := mem.AllKeysChan(ctx)
+	must(err)
+	for k := range keys {
+		b, err := mem.Get(ctx, k)
+		must(err)
+		must(rw.Put(ctx, b))
+	}
+	must(rw.Finalize())
+
+	return lchtypes.NewTipSetKey(head)
+}
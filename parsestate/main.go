@@ -3,11 +3,16 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"runtime"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	filaddr "github.com/filecoin-project/go-address"
@@ -25,8 +30,11 @@ import (
 	lchstmgr "github.com/filecoin-project/lotus/chain/stmgr"
 	lchtypes "github.com/filecoin-project/lotus/chain/types"
 
+	ipfsbs "github.com/ipfs/go-ipfs-blockstore"
 	ipldcbor "github.com/ipfs/go-ipld-cbor"
 
+	"github.com/ribasushi/fil-fip36-vote-tally/ephemeralbs"
+	"github.com/ribasushi/fil-fip36-vote-tally/rpcbs"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
@@ -51,51 +59,193 @@ const (
 	dbName  = "filstate_2162760.sqlite"
 )
 
+// blocks repeatedly read by the walkers ( HAMT/AMT roots and interior nodes )
+const readCacheBytes = 1 << 30
+
 // https://fil-chain-snapshots-fallback.s3.amazonaws.com/mainnet/minimal_finality_stateroots_2163120_2022-09-15_00-00-00.car.zst
 const srcSnapsshot = `minimal_finality_stateroots_2163120_2022-09-15_00-00-00.car`
 
+type parseOpts struct {
+	verifyBlocks bool
+	workers      int
+	backend      string
+	pgDSN        string
+	pgSchema     string
+	expectSha256 string
+	fresh        bool
+	lotusAPI     string
+	lotusToken   string
+	lotusCache   string
+
+	// where the final database ends up, and the subset of tables to populate ( nil: all )
+	outFile string
+	tables  map[string]bool
+}
+
+func (o parseOpts) wants(tables ...string) bool {
+	if o.tables == nil {
+		return true
+	}
+	for _, t := range tables {
+		if o.tables[t] {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
-	ctx := context.Background()
+	// a clean shutdown on ^C keeps the partial database consistent, ready for resuming
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var opts parseOpts
+	flag.BoolVar(&opts.verifyBlocks, "verify-blocks", false, "re-hash every block read from the snapshot against its CID ( slower, pinpoints corruption )")
+	flag.IntVar(&opts.workers, "workers", runtime.NumCPU(), "amount of concurrent state-tree walkers ( the result is identical regardless )")
+	flag.StringVar(&opts.backend, "backend", "sqlite", "output backend: sqlite or postgres")
+	flag.StringVar(&opts.pgDSN, "pg-dsn", "postgres://localhost/filstate", "postgres connection string, when -backend=postgres")
+	flag.StringVar(&opts.pgSchema, "pg-schema", "filstate_2162760", "postgres schema to create and load, when -backend=postgres")
+	flag.StringVar(&opts.expectSha256, "expect-sha256", "", "fail unless the resulting sqlite file has this sha256")
+	flag.StringVar(&opts.lotusAPI, "lotus-api", "", "read state from a lotus node API ( e.g. ws://127.0.0.1:1234/rpc/v1 ) instead of the snapshot car")
+	flag.StringVar(&opts.lotusToken, "lotus-token", "", "lotus API token, when -lotus-api is used")
+	flag.StringVar(&opts.lotusCache, "lotus-cache", path.Join(workDir, "lotus_block_cache"), "directory persisting blocks fetched via -lotus-api, empty to disable")
+	flag.BoolVar(&opts.fresh, "fresh", false, "discard the partial database of an earlier failed run instead of resuming from it ( with postgres: its loading schema, which can not be resumed from )")
+	epochSpec := flag.String("epochs", "", "dump the state as of each of these epochs instead of the poll tipset, one data/filstate_{epoch}.sqlite ( or postgres schema filstate_{epoch} ) each, e.g. 2162000,2162300-2163000/120")
+	headSpec := flag.String("head", "", "with -epochs: the tipset to look epochs up from, as comma-separated block CIDs, or 'snapshot' for the snapshot root ( default: the poll tipset )")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [verify [verify-flags] | ballots [ballots-flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if opts.workers < 1 {
+		opts.workers = 1
+	}
+	opts.expectSha256 = strings.ToLower(opts.expectSha256)
 
-	err := parseStaticData(ctx, workDir, srcSnapsshot, pollTSK)
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		if opts.expectSha256 != "" && opts.backend != "sqlite" {
+			log.Fatal("-expect-sha256 is only meaningful with the sqlite backend")
+		}
+		if *epochSpec != "" {
+			err = runEpochs(ctx, *epochSpec, *headSpec, opts)
+			break
+		}
+		opts.outFile = path.Join(workDir, dbName)
+		if err = parseStaticData(ctx, workDir, srcSnapsshot, pollTSK, opts); err == nil && opts.expectSha256 != "" {
+			err = checkSha256(ctx, opts.outFile, opts.expectSha256)
+		}
+	case "verify":
+		err = verifyRebuild(ctx, workDir, srcSnapsshot, pollTSK, opts, flag.Args()[1:])
+	case "ballots":
+		err = scanBallots(ctx, opts, flag.Args()[1:])
+	default:
+		err = xerrors.Errorf("unknown command '%s'", flag.Arg(0))
+	}
 	if err != nil {
 		log.Fatalf("%+v", err)
 	}
 }
 
+func checkSha256(ctx context.Context, dbFile, expected string) error {
+	got, err := fileSha256(dbFile)
+	if err != nil {
+		return err
+	}
+	if got == expected {
+		log.Printf("OK: %s has the expected sha256 %s", dbFile, got)
+		return nil
+	}
+
+	// hashes published before the digests table was stored in the file
+	if stripped, err := strippedSha256(dbFile); err != nil {
+		return err
+	} else if stripped == expected {
+		log.Printf("OK: %s has the expected sha256 %s once its %s table is left out", dbFile, stripped, digestsTable)
+		return nil
+	}
+
+	dg, err := fileTableDigests(ctx, dbFile, allTables())
+	if err != nil {
+		return err
+	}
+	return xerrors.Errorf("FAILED: %s has sha256 %s instead of the expected %s, per-table digests:%s", dbFile, got, expected, digestReport(dg))
+}
+
 type totCounters map[string]*int32
 
-func parseStaticData(ctx context.Context, workDir, srcSnapshot string, tsk lchtypes.TipSetKey) (defErr error) {
+func parseStaticData(ctx context.Context, workDir, srcSnapshot string, tsk lchtypes.TipSetKey, opts parseOpts) error {
 
-	dbProcDict, finalize, err := prepDb(workDir)
+	ebs, closeSrc, err := openSource(ctx, workDir, srcSnapshot, opts)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+
+	sm, err := newFilStateReader(ebs)
+	if err != nil {
+		return xerrors.Errorf("unable to initialize a StateManager: %w", err)
+	}
+
+	ts, err := sm.ChainStore().GetTipSetFromKey(ctx, tsk)
+	if err != nil {
+		return xerrors.Errorf("unable to load target tipset: %w", err)
+	}
+
+	return dumpTipset(ctx, ebs, sm, ts, srcSnapshot, opts)
+}
+
+// dumpTipset writes the state of a single tipset to opts.outFile ( or the
+// postgres schema ), reading through an already open source
+func dumpTipset(ctx context.Context, ebs *ephemeralbs.Blockstore, sm *lchstmgr.StateManager, ts *lchtypes.TipSet, srcSnapshot string, opts parseOpts) (defErr error) {
+
+	var be outputBackend
+	var resume checkpoints
+	var err error
+	switch opts.backend {
+	case "sqlite":
+		be, resume, err = prepDb(
+			path.Join(path.Dir(opts.outFile), "."+path.Base(opts.outFile)+".partial"),
+			srcSnapshot+"@"+ts.Key().String(),
+			opts.fresh,
+		)
+	case "postgres":
+		be, err = prepPostgres(ctx, opts.pgDSN, opts.pgSchema, opts.fresh)
+	default:
+		return xerrors.Errorf("unknown output backend '%s'", opts.backend)
+	}
 	if err != nil {
 		return err
 	}
 	defer func() {
 		var out string
 		if defErr == nil {
-			out = path.Join(workDir, dbName)
+			out = opts.outFile
 		}
-		finErr := finalize(out)
+		finErr := be.finalize(out)
 		if defErr == nil {
 			defErr = finErr
 		}
 	}()
 
-	carbs, err := blockstoreFromSnapshot(ctx, workDir, srcSnapsshot)
-	if err != nil {
-		return err
+	if opts.tables != nil {
+		be = subsetBackend{outputBackend: be, tables: opts.tables}
 	}
 
-	sm, err := newFilStateReader(carbs)
-	if err != nil {
-		return xerrors.Errorf("unable to initialize a StateManager: %w", err)
+	// nothing done yet: no actor within shard 0, no deal ID
+	actorsFrom, dealsFrom := checkpoint{minor: -1}, checkpoint{major: -1}
+	if c, found := resume[walkerActors]; found {
+		actorsFrom = c
 	}
-
-	ts, err := sm.ChainStore().GetTipSetFromKey(ctx, tsk)
-	if err != nil {
-		return xerrors.Errorf("unable to load target tipset: %w", err)
+	if c, found := resume[walkerDeals]; found {
+		dealsFrom = c
 	}
+	if resume != nil {
+		log.Printf("resuming partial run: actors after shard %d entry %d, deals after ID %d", actorsFrom.major, actorsFrom.minor, dealsFrom.major)
+	}
+
+	dbw := newDbWriter(be)
 
 	eg, shCtx := errgroup.WithContext(ctx)
 
@@ -105,13 +255,33 @@ func parseStaticData(ctx context.Context, workDir, srcSnapshot string, tsk lchty
 		"providers": new(int32),
 		"deals":     new(int32),
 	}
+	printCacheStats := func() {
+		cs, enabled := ebs.CacheStats()
+		if !enabled {
+			return
+		}
+		var hitPct float64
+		if cs.Hits+cs.Misses > 0 {
+			hitPct = 100 * float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+		}
+		os.Stderr.WriteString(fmt.Sprintf( //nolint:errcheck
+			"Block cache    hits:% 5d (%.1f%%)     misses:% 5d     served:% 5d MiB     fetched:% 5d MiB     evictions:% 5d\n",
+			cs.Hits, hitPct,
+			cs.Misses,
+			cs.BytesHit>>20,
+			cs.BytesMissed>>20,
+			cs.Evictions,
+		))
+	}
 	printStats := func() {
+		written, rate := dbw.throughput()
 		os.Stderr.WriteString(fmt.Sprintf( //nolint:errcheck
-			"Processed      deals:% 5d     accounts:% 5d     msigs:% 5d     providers:% 5d\r",
+			"Processed      deals:% 5d     accounts:% 5d     msigs:% 5d     providers:% 5d     rows written:% 5d (% 6.0f/s)\r",
 			atomic.LoadInt32(totals["deals"]),
 			atomic.LoadInt32(totals["accounts"]),
 			atomic.LoadInt32(totals["msigs"]),
 			atomic.LoadInt32(totals["providers"]),
+			written, rate,
 		))
 	}
 
@@ -123,6 +293,7 @@ func parseStaticData(ctx context.Context, workDir, srcSnapshot string, tsk lchty
 			case <-shCtx.Done():
 				printStats()
 				os.Stderr.WriteString("\n") //nolint:errcheck
+				printCacheStats()
 				return
 			case <-ticker.C:
 				printStats()
@@ -130,130 +301,249 @@ func parseStaticData(ctx context.Context, workDir, srcSnapshot string, tsk lchty
 		}
 	}()
 
-	eg.Go(func() error { return parseActors(shCtx, dbProcDict, sm, ts, totals) })
-	eg.Go(func() error { return parseDeals(shCtx, dbProcDict, sm, ts, totals) })
+	eg.Go(func() error { return dbw.run(shCtx) })
+	eg.Go(func() error {
+		defer dbw.close()
+
+		walkers, wCtx := errgroup.WithContext(shCtx)
+		if opts.wants("providers", "accounts", "msigs", "msig_actors") {
+			walkers.Go(func() error { return parseActors(wCtx, dbw, sm, ts, totals, opts.workers, actorsFrom) })
+		}
+		if opts.wants("deals") {
+			walkers.Go(func() error { return parseDeals(wCtx, dbw, sm, ts, totals, dealsFrom) })
+		}
+		return walkers.Wait()
+	})
 
 	return eg.Wait()
 }
 
-func parseActors(ctx context.Context, dict procDictionary, sm *lchstmgr.StateManager, ts *lchtypes.TipSet, tot totCounters) error {
-	ast := lchadt.WrapStore(ctx, ipldcbor.NewCborStore(sm.ChainStore().UnionStore()))
+// openSource returns a blockstore over either the lotus node API or the snapshot car
+func openSource(ctx context.Context, workDir, srcSnapshot string, opts parseOpts) (*ephemeralbs.Blockstore, func(), error) {
+	closer := func() {}
+
+	var srcBs ipfsbs.Blockstore
+	var err error
+	if opts.lotusAPI != "" {
+		var api *rpcbs.ChainAPI
+		api, closer, err = rpcbs.Dial(ctx, opts.lotusAPI, opts.lotusToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		if srcBs, err = rpcbs.NewRPCBlockstore(api, opts.lotusCache); err != nil {
+			closer()
+			return nil, nil, err
+		}
+	} else if srcBs, err = blockstoreFromSnapshot(ctx, workDir, srcSnapshot); err != nil {
+		return nil, nil, err
+	}
+
+	ebs := ephemeralbs.NewEphemeralBlockstore(srcBs, ephemeralbs.WithReadCache(readCacheBytes))
+	if opts.verifyBlocks {
+		ebs.HashOnRead(true)
+	}
+	return ebs, closer, nil
+}
+
+func parseActors(ctx context.Context, dbw *dbWriter, sm *lchstmgr.StateManager, ts *lchtypes.TipSet, tot totCounters, workers int, from checkpoint) error {
+	cst := ipldcbor.NewCborStore(sm.ChainStore().UnionStore())
+	ast := lchadt.WrapStore(ctx, cst)
 
 	stateTree, _ := sm.StateTree(ts.ParentState())
 	paddr, _ := stateTree.GetActor(lbipower.Address)
 	ps, _ := lbipower.Load(ast, paddr)
 
-	return stateTree.ForEach(func(addr filaddr.Address, act *lchtypes.Actor) error {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
+	shards, err := actorShards(ctx, cst, ts.ParentState())
+	if err != nil {
+		return err
+	}
 
-		switch {
+	eg, ctx := errgroup.WithContext(ctx)
 
-		case lbi.IsStorageMinerActor(act.Code):
+	// every shard gets its own output queue: the writer below drains them
+	// strictly in HAMT order, so the DB comes out identical to a sequential walk
+	outs := make([]chan []dbRow, len(shards))
+	for i := range outs {
+		outs[i] = make(chan []dbRow, 1<<10)
+	}
 
-			p, err := lbiprovider.Load(ast, act)
-			if err != nil {
-				return err
+	eg.Go(func() error {
+		// slots are handed out in shard order: the shard the writer is waiting
+		// on is always either finished or already running
+		sem := make(chan struct{}, workers)
+		for i := int(from.major); i < len(shards); i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 
-			pi, err := p.Info()
-			if err != nil {
-				return err
-			}
+			i := i
+			eg.Go(func() error {
+				defer func() { <-sem }()
+				defer close(outs[i])
+
+				var ordinal int64 = -1
+				return shards[i].forEach(ctx, cst, func(addr filaddr.Address, act *lchtypes.Actor) error {
+					ordinal++
+					if i == int(from.major) && ordinal <= from.minor {
+						return nil
+					}
+
+					rows, err := actorRows(ast, ps, ts, addr, act, tot)
+					if err != nil || len(rows) == 0 {
+						return err
+					}
+					select {
+					case outs[i] <- append(rows, checkpointRow(walkerActors, int64(i), ordinal)):
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+			})
+		}
+		return nil
+	})
 
-			pc, eligibleToMine, err := ps.MinerPower(addr)
-			if err != nil {
-				return err
-			}
-			if !eligibleToMine {
-				pc.RawBytePower = filbig.Zero()
-				pc.QualityAdjPower = filbig.Zero()
+	// single ordered forwarder to the writer
+	eg.Go(func() error {
+		for i := int(from.major); i < len(outs); i++ {
+			for shardDone := false; !shardDone; {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case rows, open := <-outs[i]:
+					if !open {
+						shardDone = true
+						break
+					}
+					if err := dbw.send(ctx, rows); err != nil {
+						return err
+					}
+				}
 			}
+		}
+		return nil
+	})
 
-			bal, err := p.AvailableBalance(act.Balance)
-			if err != nil {
-				return err
-			}
-			vest, err := p.VestedFunds(ts.Height())
-			if err != nil {
-				return err
-			}
+	return eg.Wait()
+}
+
+func actorRows(ast lchadt.Store, ps lbipower.State, ts *lchtypes.TipSet, addr filaddr.Address, act *lchtypes.Actor, tot totCounters) ([]dbRow, error) {
+	switch {
+
+	case lbi.IsStorageMinerActor(act.Code):
+
+		p, err := lbiprovider.Load(ast, act)
+		if err != nil {
+			return nil, err
+		}
+
+		pi, err := p.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		pc, eligibleToMine, err := ps.MinerPower(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !eligibleToMine {
+			pc.RawBytePower = filbig.Zero()
+			pc.QualityAdjPower = filbig.Zero()
+		}
 
-			atomic.AddInt32(tot["providers"], 1)
-			_, err = dict[procAddProvider].Exec(
+		bal, err := p.AvailableBalance(act.Balance)
+		if err != nil {
+			return nil, err
+		}
+		vest, err := p.VestedFunds(ts.Height())
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddInt32(tot["providers"], 1)
+		return []dbRow{{
+			procAddProvider,
+			[]interface{}{
 				mustAddrID(addr),
 				mustAddrID(pi.Owner),
 				mustAddrID(pi.Worker),
 				pc.RawBytePower.String(),
 				pc.QualityAdjPower.String(),
 				filbig.Add(bal, vest).String(),
-			)
-			return err
+			},
+		}}, nil
 
-		case lbi.IsAccountActor(act.Code):
+	case lbi.IsAccountActor(act.Code):
 
-			w, err := lbiaccount.Load(ast, act)
-			if err != nil {
-				return err
-			}
-			pa, err := w.PubkeyAddress()
-			if err != nil {
-				return err
-			}
+		w, err := lbiaccount.Load(ast, act)
+		if err != nil {
+			return nil, err
+		}
+		pa, err := w.PubkeyAddress()
+		if err != nil {
+			return nil, err
+		}
 
-			atomic.AddInt32(tot["accounts"], 1)
-			_, err = dict[procAddAccount].Exec(
+		atomic.AddInt32(tot["accounts"], 1)
+		return []dbRow{{
+			procAddAccount,
+			[]interface{}{
 				mustAddrID(addr),
 				pa.String(),
 				act.Balance.String(),
-			)
-			return err
+			},
+		}}, nil
 
-		case lbi.IsMultisigActor(act.Code):
+	case lbi.IsMultisigActor(act.Code):
 
-			ms, err := lbimsig.Load(ast, act)
-			if err != nil {
-				return err
-			}
-			msID := mustAddrID(addr)
-			tr, _ := ms.Threshold()
+		ms, err := lbimsig.Load(ast, act)
+		if err != nil {
+			return nil, err
+		}
+		msID := mustAddrID(addr)
+		tr, _ := ms.Threshold()
 
-			actors, err := ms.Signers()
-			if err != nil {
-				return err
-			}
-			for _, a := range actors {
-				if _, err := dict[procAddMsigActors].Exec(
+		actors, err := ms.Signers()
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]dbRow, 0, len(actors)+1)
+		for _, a := range actors {
+			rows = append(rows, dbRow{
+				procAddMsigActors,
+				[]interface{}{
 					msID,
 					mustAddrID(a),
-				); err != nil {
-					return err
-				}
-			}
+				},
+			})
+		}
 
-			// msig balance needs calculating for epoch in question
-			lb, err := ms.LockedBalance(ts.Height())
-			if err != nil {
-				return err
-			}
+		// msig balance needs calculating for epoch in question
+		lb, err := ms.LockedBalance(ts.Height())
+		if err != nil {
+			return nil, err
+		}
 
-			atomic.AddInt32(tot["msigs"], 1)
-			_, err = dict[procAddMsig].Exec(
+		atomic.AddInt32(tot["msigs"], 1)
+		return append(rows, dbRow{
+			procAddMsig,
+			[]interface{}{
 				msID,
 				tr,
 				filbig.Sub(act.Balance, lb).String(),
-			)
-			return err
+			},
+		}), nil
 
-		default:
-			return nil
+	default:
+		return nil, nil
 
-		}
-	})
+	}
 }
 
-func parseDeals(ctx context.Context, dict procDictionary, sm *lchstmgr.StateManager, ts *lchtypes.TipSet, tot totCounters) error {
+func parseDeals(ctx context.Context, dbw *dbWriter, sm *lchstmgr.StateManager, ts *lchtypes.TipSet, tot totCounters, from checkpoint) error {
 
 	ms, err := sm.GetMarketState(ctx, ts)
 	if err != nil {
@@ -270,10 +560,17 @@ func parseDeals(ctx context.Context, dict procDictionary, sm *lchstmgr.StateMana
 		return err
 	}
 
-	return marketProps.ForEach(func(dealID filabi.DealID, d lbimarket.DealProposal) error {
+	// a channel send per deal is wasteful, ship them in small batches
+	const dealBatch = 1 << 10
+	batch := make([]dbRow, 0, dealBatch)
+
+	if err := marketProps.ForEach(func(dealID filabi.DealID, d lbimarket.DealProposal) error {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		if int64(dealID) <= from.major {
+			return nil
+		}
 
 		s, sectorStateFound, err := marketStates.Get(dealID)
 		if err != nil {
@@ -301,22 +598,38 @@ func parseDeals(ctx context.Context, dict procDictionary, sm *lchstmgr.StateMana
 		}
 
 		atomic.AddInt32(tot["deals"], 1)
-		_, err = dict[procAddDeal].Exec(
-			dealID,
-			mustAddrID(d.Client),
-			mustAddrID(d.Provider),
-			d.PieceCID.String(),
-			label,
-			d.PieceSize,
-			d.VerifiedDeal,
-			d.StoragePricePerEpoch.Int64(),
-			d.ProviderCollateral.Int64(),
-			d.ClientCollateral.Int64(),
-			d.StartEpoch,
-			d.EndEpoch,
-			sectorStart,
-			dealSlash,
-		)
+		batch = append(batch, dbRow{
+			procAddDeal,
+			[]interface{}{
+				dealID,
+				mustAddrID(d.Client),
+				mustAddrID(d.Provider),
+				d.PieceCID.String(),
+				label,
+				d.PieceSize,
+				d.VerifiedDeal,
+				d.StoragePricePerEpoch.Int64(),
+				d.ProviderCollateral.Int64(),
+				d.ClientCollateral.Int64(),
+				d.StartEpoch,
+				d.EndEpoch,
+				sectorStart,
+				dealSlash,
+			},
+		})
+		if len(batch) < dealBatch {
+			return nil
+		}
+
+		err = dbw.send(ctx, append(batch, checkpointRow(walkerDeals, int64(dealID), 0)))
+		batch = make([]dbRow, 0, dealBatch)
 		return err
-	})
+	}); err != nil {
+		return err
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return dbw.send(ctx, append(batch, checkpointRow(walkerDeals, int64(batch[len(batch)-1].args[0].(filabi.DealID)), 0)))
 }
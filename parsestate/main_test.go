@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	filaddr "github.com/filecoin-project/go-address"
+	lchstate "github.com/filecoin-project/lotus/chain/state"
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	builtin7 "github.com/filecoin-project/specs-actors/v7/actors/builtin"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// expected contents of every table produced from smallState, rows rendered
+// as |-separated columns, ordered by all columns
+var smallStateRows = map[string][]string{
+	"deals": {
+		"0|100|300|bafy2bzaceccrnldcsbrg4ouzw64mrhg774qvjf3gxnnj3pzuzjlsmluwz5k5q|bafyactive|1048576|true|0|10|0|500|2000|400|NULL",
+		"1|102|300|bafy2bzacea7b5taaqywjova6xukz6fr5rojpjnjzdj4fpkkm7xdmzq4uapxde||2097152|false|7|20|1|600|900|550|NULL",
+		"2|100|301|bafy2bzacedt57b3nn2ykruwc36ruz3j5iyx3pkhiym5k5xrd5znwwc6kcotic|slashed|4194304|false|1|30|2|700|5000|650|800",
+		"3|103|301|bafy2bzacea4dis3kwkowjfn4xzrowgtnlihke6nvs6dx7hjhaafsy4tclunso|pending|8388608|true|3|40|3|1500|3000|NULL|NULL",
+	},
+	// 301 has no power claim
+	"providers": {
+		"300|100|101|34359738368|343597383680|7000",
+		"301|200|103|0|0|9000",
+	},
+	"accounts": {
+		"100|f1nvfp3sqenc3cqr5blwm3ztnofw5kf724zplvpea|1000000",
+		"101|f1m2jd3aq2udcltclf5z3bl2dqutykqde7swxgjda|2000000",
+		"102|f1nqw5xepu7eimueh5prznuhrhlnwhhgiwtosheqa|0",
+		"103|f1b37jllrx7avrxzwio242ypw5ikmtvrcp32bo4ti|42",
+	},
+	// 3/4 of the 4000 initial balance of 201 are still locked at fixtureHeight
+	"msigs": {
+		"200|2|5000",
+		"201|2|1000",
+	},
+	"msig_actors": {
+		"200|100",
+		"200|101",
+		"201|102",
+		"201|103",
+		"201|200",
+	},
+}
+
+// the sha256 of the database produced from this fixture, table_digests included
+const smallStateSha256 = "d7838bb121881cb088eb828535cda6ae58467781ede963171b93962c5b34e600"
+
+// the code that produced the published database, before table_digests existed,
+// yields the very same file from this fixture as what is left once it is dropped:
+// anything changing it changes the published sha256 too
+const smallStateStrippedSha256 = "03e19e7bad8ae0d3f90a89e28b53c284959d3899c90a0efae6a5cd70c8eca53f"
+
+func dumpTable(t *testing.T, db *sql.DB, td tableDef) []string {
+	t.Helper()
+
+	rows, err := db.Query(fmt.Sprintf(
+		`SELECT %s FROM %s ORDER BY %s`,
+		strings.Join(td.columns, ", "), td.table, strings.Join(td.columns, ", "),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(td.columns))
+		ptrs := make([]interface{}, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		cols := make([]string, len(vals))
+		for i, v := range vals {
+			cols[i] = "NULL"
+			if v.Valid {
+				cols[i] = v.String
+			}
+		}
+		out = append(out, strings.Join(cols, "|"))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestParseStaticData(t *testing.T) {
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", smallState)
+
+	// the result must not depend on the amount of walkers
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			outFile := filepath.Join(dir, fmt.Sprintf("out_%d.sqlite", workers))
+			if err := parseStaticData(context.Background(), dir, "fixture.car", tsk, parseOpts{
+				workers: workers,
+				backend: "sqlite",
+				outFile: outFile,
+			}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			db, err := sql.Open("sqlite3", outFile+"?mode=ro")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close() //nolint:errcheck
+
+			for _, tbl := range allTables() {
+				td, _ := tableDefByName(tbl)
+				if got := dumpTable(t, db, td); !reflect.DeepEqual(got, smallStateRows[tbl]) {
+					t.Errorf("table %s:\n got: %#v\nwant: %#v", tbl, got, smallStateRows[tbl])
+				}
+			}
+
+			if sha, err := fileSha256(outFile); err != nil {
+				t.Fatal(err)
+			} else if sha != smallStateSha256 {
+				t.Errorf("sha256 of result: got %s, want %s", sha, smallStateSha256)
+			}
+		})
+	}
+}
+
+// smallState with enough extra accounts for the state tree HAMT to grow links
+// at both shard depths, rather than fitting into the inline buckets of its root
+func largeState() fixtureState {
+	fs := smallState
+	fs.accounts = append([]fixtureAccount(nil), smallState.accounts...)
+	for id := uint64(1000); id < 5000; id++ {
+		fs.accounts = append(fs.accounts, fixtureAccount{id, fmt.Sprintf("acct-%d", id), int64(id)})
+	}
+	return fs
+}
+
+func TestParseStaticDataSharded(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", largeState())
+
+	carbs, err := blockstoreFromSnapshot(ctx, dir, "fixture.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cst := ipldcbor.NewCborStore(carbs)
+	var hdr lchtypes.BlockHeader
+	if err := cst.Get(ctx, tsk.Cids()[0], &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the fixture exercises what it is meant to
+	shards, err := actorShards(ctx, cst, hdr.ParentStateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linked int
+	for _, s := range shards {
+		if s.link.Defined() {
+			linked++
+		}
+	}
+	if linked == 0 {
+		t.Fatalf("none of the %d shards is a linked depth-2 subtree", len(shards))
+	}
+
+	// the reference order: a plain sequential walk of the state tree
+	tree, err := lchstate.LoadStateTree(cst, hdr.ParentStateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expOrder []string
+	if err := tree.ForEach(func(addr filaddr.Address, act *lchtypes.Actor) error {
+		if act.Code == builtin7.AccountActorCodeID {
+			id, err := filaddr.IDFromAddress(addr)
+			expOrder = append(expOrder, fmt.Sprint(id))
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expSha string
+	for _, workers := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			outFile := filepath.Join(dir, fmt.Sprintf("out_%d.sqlite", workers))
+			if err := parseStaticData(ctx, dir, "fixture.car", tsk, parseOpts{
+				workers: workers,
+				backend: "sqlite",
+				outFile: outFile,
+			}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			db, err := sql.Open("sqlite3", outFile+"?mode=ro")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close() //nolint:errcheck
+
+			if got := dumpTable(t, db, tableDef{table: "accounts", columns: []string{"rowid", "account_id"}}); len(got) != len(expOrder) {
+				t.Fatalf("expected %d accounts, got %d", len(expOrder), len(got))
+			} else {
+				for i, r := range got {
+					if r != fmt.Sprintf("%d|%s", i+1, expOrder[i]) {
+						t.Fatalf("account #%d out of state tree order: got %s, want %s", i+1, r, expOrder[i])
+					}
+				}
+			}
+
+			sha, err := fileSha256(outFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expSha == "" {
+				expSha = sha
+			} else if sha != expSha {
+				t.Errorf("sha256 of result with %d workers: got %s, want %s as with a single one", workers, sha, expSha)
+			}
+		})
+	}
+}
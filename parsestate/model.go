@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/binary"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,6 +17,11 @@ import (
 type procID int
 type procDictionary map[procID]*sql.Stmt
 
+type dbRow struct {
+	proc procID
+	args []interface{}
+}
+
 const (
 	procAddDeal = procID(iota)
 	procAddProvider
@@ -21,21 +30,176 @@ const (
 	procAddMsigActors
 )
 
-func prepDb(workDir string) (procDictionary, func(string) error, error) {
+// outputBackend is where all the rows produced by the walkers end up
+type outputBackend interface {
+	// flush persists rows, in order, as a single transaction
+	flush(context.Context, []dbRow) error
+	// finalize is called exactly once at the end, with "" if the run failed
+	finalize(outFile string) error
+}
 
-	tmpFile, err := os.CreateTemp(workDir, `.filstate_db_*`)
-	if err != nil {
-		return nil, func(string) error { return nil }, xerrors.Errorf("unable to create temporary sqlite file: %w", err)
+// columnDef is a column as declared in the SQLite output: pgType overrides
+// the type within def when the two databases need something different
+type columnDef struct {
+	name   string
+	def    string
+	pgType string
+}
+
+type tableDef struct {
+	table       string
+	columns     []string
+	defs        []columnDef
+	constraints []string
+}
+
+func newTableDef(table string, defs []columnDef, constraints ...string) tableDef {
+	t := tableDef{table: table, defs: defs, constraints: constraints}
+	for _, d := range defs {
+		t.columns = append(t.columns, d.name)
+	}
+	return t
+}
+
+// the single definition of every table, for all backends
+var procTables = map[procID]tableDef{
+	procAddDeal: newTableDef("deals", []columnDef{
+		{name: "deal_id", def: "BIGINT NOT NULL UNIQUE"},
+		{name: "client_id", def: "INTEGER NOT NULL"},
+		{name: "provider_id", def: "INTEGER NOT NULL"},
+		{name: "piece_cid", def: "TEXT NOT NULL"},
+		// arbitrary bytes, which postgres does not accept as TEXT
+		{name: "label", def: "TEXT NOT NULL", pgType: "BYTEA"},
+		{name: "piece_size", def: "BIGINT NOT NULL"},
+		{name: "is_filplus", def: "BOOLEAN NOT NULL"},
+		{name: "price_per_epoch", def: "BIGINT NOT NULL"},
+		{name: "provider_collateral", def: "BIGINT NOT NULL"},
+		{name: "client_collateral", def: "BIGINT NOT NULL"},
+		{name: "start_epoch", def: "INTEGER NOT NULL"},
+		{name: "end_epoch", def: "INTEGER NOT NULL"},
+		{name: "sector_activation_epoch", def: "INTEGER"},
+		{name: "deal_slash_epoch", def: "INTEGER"},
+	}),
+	procAddProvider: newTableDef("providers", []columnDef{
+		{name: "provider_id", def: "INTEGER NOT NULL UNIQUE"},
+		{name: "owner_id", def: "INTEGER NOT NULL"},
+		{name: "worker_id", def: "INTEGER NOT NULL"},
+		{name: "power_raw", def: "TEXT NOT NULL"},
+		{name: "power_qa", def: "TEXT NOT NULL"},
+		{name: "balance", def: "TEXT NOT NULL"},
+	}),
+	procAddAccount: newTableDef("accounts", []columnDef{
+		{name: "account_id", def: "INTEGER NOT NULL UNIQUE"},
+		{name: "account_address", def: "TEXT NOT NULL UNIQUE"},
+		{name: "balance", def: "TEXT NOT NULL"},
+	}),
+	procAddMsig: newTableDef("msigs", []columnDef{
+		{name: "msig_id", def: "INTEGER NOT NULL UNIQUE"},
+		{name: "threshold", def: "SMALLINT NOT NULL"},
+		{name: "balance", def: "TEXT NOT NULL"},
+	}),
+	procAddMsigActors: newTableDef("msig_actors", []columnDef{
+		{name: "msig_id", def: "INTEGER NOT NULL"},
+		{name: "actor_id", def: "INTEGER NOT NULL"},
+	}, "UNIQUE( msig_id, actor_id )"),
+}
+
+// createSQL renders the CREATE TABLE statement, for postgres with its own
+// types and BIGINT ids. SQLite keeps the statement text in the file itself:
+// it is laid out exactly like the statements that produced the published
+// database, any change to it changes the sha256 of the result.
+func (t tableDef) createSQL(pg bool) string {
+	lines := make([]string, 0, len(t.defs)+len(t.constraints))
+	for _, d := range t.defs {
+		def := d.def
+		if pg {
+			typ, rest, _ := strings.Cut(def, " ")
+			if d.pgType != "" {
+				typ = d.pgType
+			} else if typ == "INTEGER" {
+				typ = "BIGINT"
+			}
+			def = strings.TrimSpace(typ + " " + rest)
+		}
+		lines = append(lines, "\t\t\t"+d.name+" "+def)
+	}
+	for _, c := range t.constraints {
+		lines = append(lines, "\t\t\t"+c)
+	}
+	return "\n\t\tCREATE TABLE " + t.table + " (\n" + strings.Join(lines, ",\n") + "\n\t\t)"
+}
+
+// schemaSQL lists the CREATE TABLE statements of all tables, in procID order
+func schemaSQL(pg bool) []string {
+	stmts := make([]string, 0, len(procTables))
+	for id := procID(0); int(id) < len(procTables); id++ {
+		stmts = append(stmts, procTables[id].createSQL(pg))
+	}
+	return stmts
+}
+
+func (t tableDef) insertSQL() string {
+	ph := make([]string, len(t.columns))
+	for i := range ph {
+		ph[i] = "$" + strconv.Itoa(i+1)
+	}
+	return fmt.Sprintf(
+		"INSERT INTO %s ( %s ) VALUES ( %s )",
+		t.table,
+		strings.Join(t.columns, ", "),
+		strings.Join(ph, ", "),
+	)
+}
+
+// prepDb writes into partialFile, which is left in place when a run fails:
+// a subsequent run with the same runParams picks up where the last one left off
+func prepDb(partialFile, runParams string, fresh bool) (_ *sqliteBackend, _ checkpoints, defErr error) {
+
+	var resume checkpoints
+	if !fresh {
+		var err error
+		if resume, err = readCheckpoints(partialFile, runParams); err != nil {
+			log.Printf("discarding partial database %s: %s", partialFile, err)
+		}
+	}
+	if resume == nil {
+		if err := os.Remove(partialFile); err != nil && !os.IsNotExist(err) {
+			return nil, nil, xerrors.Errorf("unable to remove stale partial database: %w", err)
+		}
 	}
 
 	var db *sql.DB
 	fin := func(p string) error {
-		defer os.Remove(tmpFile.Name()) //nolint:errcheck
+		if db == nil {
+			return nil
+		}
 
-		if db == nil || p == "" {
+		if p == "" {
+			if err := db.Close(); err != nil {
+				return err
+			}
+			log.Printf("partial database kept at %s, rerun to resume", partialFile)
 			return nil
 		}
 
+		for _, s := range []string{
+			`DROP TABLE checkpoint_run`,
+			`DROP TABLE checkpoints`,
+		} {
+			if _, err := db.Exec(s); err != nil {
+				return xerrors.Errorf("unable to drop checkpoint tables: %w", err)
+			}
+		}
+
+		dg, err := tableDigests(context.Background(), db, allTables())
+		if err != nil {
+			return err
+		}
+		log.Printf("Table content digests:%s\n", digestReport(dg))
+		if err := storeDigests(context.Background(), db, dg); err != nil {
+			return err
+		}
+
 		if _, err := db.Exec("VACUUM"); err != nil {
 			return xerrors.Errorf("vacuum at finalize failed: %w", err)
 		}
@@ -43,163 +207,118 @@ func prepDb(workDir string) (procDictionary, func(string) error, error) {
 			return xerrors.Errorf("failure flushing DB at close(): %w", err)
 		}
 
-		// Surgery on the database file header itself, making it reproducible
-		//
-		{
-			// https://www.sqlite.org/fileformat.html#file_change_counter
-			// https://www.sqlite.org/fileformat.html#schema_cookie
-			// https://www.sqlite.org/fileformat.html#validfor
-			for _, offset := range []int64{24, 40, 92} {
-				if _, err := tmpFile.WriteAt([]byte{0, 0, 0, 1}, offset); err != nil {
-					return xerrors.Errorf("db header correction failed: %w", err)
-				}
-			}
-
-			// https://www.sqlite.org/fileformat.html#write_library_version_number_and_version_valid_for_number
-			// freeze "last SQLite access" version at reasonable minimum
-			if _, err := tmpFile.WriteAt(
-				binary.BigEndian.AppendUint32(make([]byte, 0, 4), 3022000),
-				96,
-			); err != nil {
-				return xerrors.Errorf("db header correction failed: %w", err)
-			}
+		if err := resetHeader(partialFile); err != nil {
+			return err
 		}
-		// end surgery
-
-		return os.Rename(tmpFile.Name(), p)
+		return os.Rename(partialFile, p)
 	}
 
-	db, err = sql.Open(
-		"sqlite3", tmpFile.Name()+"?"+strings.Join([]string{
-			"mode=rw",
+	defer func() {
+		if defErr != nil {
+			fin("") //nolint:errcheck
+		}
+	}()
+
+	// a rollback journal on disk: an interrupted transaction must not corrupt the partial file
+	db, err := sql.Open(
+		"sqlite3", partialFile+"?"+strings.Join([]string{
+			"mode=rwc",
 			"_foreign_keys=1",
 			"_defer_foreign_keys=1",
 			"_timeout=5000",
 			"_vacuum=none",
-			"_journal=memory",
+			"_journal=truncate",
 			"_sync=off",
 		}, "&"),
 	)
 	if err != nil {
-		return nil, fin, xerrors.Errorf("failed to open database in temporary file: %w", err)
-	}
-
-	for _, s := range []string{
-		`
-		CREATE TABLE deals (
-			deal_id BIGINT NOT NULL UNIQUE,
-			client_id INTEGER NOT NULL,
-			provider_id INTEGER NOT NULL,
-			piece_cid TEXT NOT NULL,
-			label TEXT NOT NULL,
-			piece_size BIGINT NOT NULL,
-			is_filplus BOOLEAN NOT NULL,
-			price_per_epoch BIGINT NOT NULL,
-			provider_collateral BIGINT NOT NULL,
-			client_collateral BIGINT NOT NULL,
-			start_epoch INTEGER NOT NULL,
-			end_epoch INTEGER NOT NULL,
-			sector_activation_epoch INTEGER,
-			deal_slash_epoch INTEGER
-		)`,
-		`
-		CREATE TABLE providers (
-			provider_id INTEGER NOT NULL UNIQUE,
-			owner_id INTEGER NOT NULL,
-			worker_id INTEGER NOT NULL,
-			power_raw TEXT NOT NULL,
-			power_qa TEXT NOT NULL,
-			balance TEXT NOT NULL
-		)
-		`,
-		`
-		CREATE TABLE accounts (
-			account_id INTEGER NOT NULL UNIQUE,
-			account_address TEXT NOT NULL UNIQUE,
-			balance TEXT NOT NULL
-		)
-		`,
-		`
-		CREATE TABLE msigs (
-			msig_id INTEGER NOT NULL UNIQUE,
-			threshold SMALLINT NOT NULL,
-			balance TEXT NOT NULL
-		)
-		`,
-		`
-		CREATE TABLE msig_actors (
-			msig_id INTEGER NOT NULL,
-			actor_id INTEGER NOT NULL,
-			UNIQUE( msig_id, actor_id )
-		)
-		`,
-	} {
-		if _, err := db.Exec(s); err != nil {
-			return nil, fin, xerrors.Errorf("schema init failed: %w", err)
-		}
-	}
-
-	dict := make(procDictionary, 8)
-
-	if dict[procAddDeal], err = db.Prepare(
-		`
-		INSERT INTO deals (
-			deal_id, client_id, provider_id, piece_cid, label, piece_size, is_filplus, price_per_epoch, provider_collateral, client_collateral, start_epoch, end_epoch, sector_activation_epoch, deal_slash_epoch
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9 ,$10, $11, $12, $13, $14
-		)
-		`,
-	); err != nil {
-		return nil, fin, err
+		return nil, nil, xerrors.Errorf("failed to open partial database: %w", err)
 	}
 
-	if dict[procAddProvider], err = db.Prepare(
-		`
-		INSERT INTO providers (
-			provider_id, owner_id, worker_id, power_raw, power_qa, balance
-		) VALUES (
-			$1, $2, $3, $4, $5, $6
-		)
-		`,
-	); err != nil {
-		return nil, fin, err
+	// everything goes through a single writer anyway, keep its transactions on one connection
+	db.SetMaxOpenConns(1)
+
+	if resume == nil {
+		for _, s := range append(schemaSQL(false), checkpointSchema...) {
+			if _, err := db.Exec(s); err != nil {
+				return nil, nil, xerrors.Errorf("schema init failed: %w", err)
+			}
+		}
+		if _, err := db.Exec(`INSERT INTO checkpoint_run ( params ) VALUES ( $1 )`, runParams); err != nil {
+			return nil, nil, xerrors.Errorf("schema init failed: %w", err)
+		}
 	}
 
-	if dict[procAddAccount], err = db.Prepare(
-		`
-		INSERT INTO accounts (
-			account_id, account_address, balance
-		) VALUES (
-			$1, $2, $3
-		)
-		`,
-	); err != nil {
-		return nil, fin, err
+	dict := make(procDictionary, len(procTables)+1)
+	for id, t := range procTables {
+		if dict[id], err = db.Prepare(t.insertSQL()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if dict[procCheckpoint], err = db.Prepare(checkpointSQL); err != nil {
+		return nil, nil, err
 	}
 
-	if dict[procAddMsig], err = db.Prepare(
-		`
-		INSERT INTO msigs (
-			msig_id, threshold, balance
-		) VALUES (
-			$1, $2, $3
-		)
-		`,
-	); err != nil {
-		return nil, fin, err
+	return &sqliteBackend{db: db, dict: dict, fin: fin}, resume, nil
+}
+
+type sqliteBackend struct {
+	db   *sql.DB
+	dict procDictionary
+	fin  func(string) error
+}
+
+func (b *sqliteBackend) flush(ctx context.Context, rows []dbRow) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return xerrors.Errorf("unable to start write transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmts := make(procDictionary, len(b.dict))
+	for id, s := range b.dict {
+		stmts[id] = tx.StmtContext(ctx, s)
+	}
+
+	for _, r := range rows {
+		if _, err := stmts[r.proc].Exec(r.args...); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("unable to commit write transaction: %w", err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) finalize(outFile string) error { return b.fin(outFile) }
+
+// resetHeader does surgery on the database file header itself, making it reproducible
+func resetHeader(dbFile string) error {
+	fh, err := os.OpenFile(dbFile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	// https://www.sqlite.org/fileformat.html#file_change_counter
+	// https://www.sqlite.org/fileformat.html#schema_cookie
+	// https://www.sqlite.org/fileformat.html#validfor
+	for _, offset := range []int64{24, 40, 92} {
+		if _, err := fh.WriteAt([]byte{0, 0, 0, 1}, offset); err != nil {
+			return xerrors.Errorf("db header correction failed: %w", err)
+		}
 	}
 
-	if dict[procAddMsigActors], err = db.Prepare(
-		`
-		INSERT INTO msig_actors (
-			msig_id, actor_id
-		) VALUES (
-			$1, $2
-		)
-		`,
+	// https://www.sqlite.org/fileformat.html#write_library_version_number_and_version_valid_for_number
+	// freeze "last SQLite access" version at reasonable minimum
+	if _, err := fh.WriteAt(
+		binary.BigEndian.AppendUint32(make([]byte, 0, 4), 3022000),
+		96,
 	); err != nil {
-		return nil, fin, err
+		return xerrors.Errorf("db header correction failed: %w", err)
 	}
 
-	return dict, fin, nil
+	return fh.Close()
 }
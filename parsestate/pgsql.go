@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/xerrors"
+)
+
+type pgBackend struct {
+	conn    *pgx.Conn
+	schema  string
+	written map[procID]bool
+}
+
+// prepPostgres loads everything into a "${schema}_loading" schema, which is
+// renamed to the final name only after a successful run: the same "temp file
+// and rename" dance as with SQLite. Unlike with SQLite a failed run can not be
+// resumed: its leftover loading schema is only ever dropped, and only when
+// asked to via fresh.
+func prepPostgres(ctx context.Context, dsn, schema string, fresh bool) (_ *pgBackend, defErr error) {
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to connect to postgres: %w", err)
+	}
+	b := &pgBackend{conn: conn, schema: schema, written: make(map[procID]bool, len(procTables))}
+	defer func() {
+		if defErr != nil {
+			conn.Close(ctx) //nolint:errcheck
+		}
+	}()
+
+	schemaExists := func(name string) (exists bool, err error) {
+		err = conn.QueryRow(
+			ctx,
+			`SELECT EXISTS ( SELECT 42 FROM pg_namespace WHERE nspname = $1 )`,
+			name,
+		).Scan(&exists)
+		return exists, err
+	}
+	if exists, err := schemaExists(schema); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, xerrors.Errorf("target schema %s already exists, drop it first", schema)
+	}
+	if exists, err := schemaExists(schema + "_loading"); err != nil {
+		return nil, err
+	} else if exists && !fresh {
+		return nil, xerrors.Errorf("schema %s_loading was left behind by a failed run: resuming is not supported with the postgres backend, rerun with -fresh to discard it", schema)
+	}
+
+	for _, s := range append(
+		[]string{
+			`DROP SCHEMA IF EXISTS ` + b.loadingSchema() + ` CASCADE`,
+			`CREATE SCHEMA ` + b.loadingSchema(),
+			`SET search_path = ` + b.loadingSchema(),
+		},
+		schemaSQL(true)...,
+	) {
+		if _, err := conn.Exec(ctx, s); err != nil {
+			return nil, xerrors.Errorf("schema init failed: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *pgBackend) loadingSchema() string {
+	return pgx.Identifier{b.schema + "_loading"}.Sanitize()
+}
+
+func (b *pgBackend) flush(ctx context.Context, rows []dbRow) error {
+
+	// COPY is per-table: split up, retaining order within each table
+	perTable := make(map[procID][][]interface{}, len(procTables))
+	for _, r := range rows {
+		// resuming is refused upfront, positions are of no use
+		if r.proc == procCheckpoint {
+			continue
+		}
+		vals := make([]interface{}, len(r.args))
+		for i, a := range r.args {
+			// same conversion database/sql applies when talking to SQLite
+			v, err := driver.DefaultParameterConverter.ConvertValue(a)
+			if err != nil {
+				return xerrors.Errorf("unable to convert value %#v for table %s: %w", a, procTables[r.proc].table, err)
+			}
+			vals[i] = v
+		}
+		perTable[r.proc] = append(perTable[r.proc], vals)
+		b.written[r.proc] = true
+	}
+
+	tx, err := b.conn.Begin(ctx)
+	if err != nil {
+		return xerrors.Errorf("unable to start write transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	// iterate in procID order, so that a run is reproducible down to the WAL
+	for id := procID(0); int(id) < len(procTables); id++ {
+		if len(perTable[id]) == 0 {
+			continue
+		}
+		t := procTables[id]
+		if _, err := tx.CopyFrom(
+			ctx,
+			pgx.Identifier{b.schema + "_loading", t.table},
+			t.columns,
+			pgx.CopyFromRows(perTable[id]),
+		); err != nil {
+			return xerrors.Errorf("COPY into %s failed: %w", t.table, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// finalize keeps the loading schema of a failed run around for inspection:
+// the next run refuses to start until it is dropped ( see prepPostgres )
+func (b *pgBackend) finalize(outFile string) error {
+	ctx := context.Background()
+	defer b.conn.Close(ctx) //nolint:errcheck
+
+	if outFile == "" {
+		log.Printf("partial load kept in schema %s_loading, rerun with -fresh to discard it", b.schema)
+		return nil
+	}
+
+	stmts := []string{`ALTER SCHEMA ` + b.loadingSchema() + ` RENAME TO ` + pgx.Identifier{b.schema}.Sanitize()}
+	var tables []string
+	for id := procID(0); int(id) < len(procTables); id++ {
+		if b.written[id] {
+			tables = append(tables, pgx.Identifier{b.schema, procTables[id].table}.Sanitize())
+		}
+	}
+	if len(tables) > 0 {
+		stmts = append(stmts, `ANALYZE `+strings.Join(tables, ", "))
+	}
+
+	for _, s := range stmts {
+		if _, err := b.conn.Exec(ctx, s); err != nil {
+			return xerrors.Errorf("postgres finalization failed: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// e.g. FILSTATE_TEST_PG_DSN=postgres://postgres@localhost/filstate against
+// the container from the README: every run uses a schema of its own
+const pgTestDSNEnv = "FILSTATE_TEST_PG_DSN"
+
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv(pgTestDSNEnv)
+	if dsn == "" {
+		t.Skipf("set %s to test against a local postgres", pgTestDSNEnv)
+	}
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", smallState)
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+	db.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("filstate_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		for _, s := range []string{schema, schema + "_loading"} {
+			db.Exec(`DROP SCHEMA IF EXISTS ` + s + ` CASCADE`) //nolint:errcheck
+		}
+	})
+
+	opts := parseOpts{
+		workers:  2,
+		backend:  "postgres",
+		pgDSN:    dsn,
+		pgSchema: schema,
+	}
+
+	// the leftover of a failed run is never resumed from, nor silently dropped
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema + `_loading`); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, opts); err == nil || !strings.Contains(err.Error(), "-fresh") {
+		t.Fatalf("expected a refusal to resume, got %v", err)
+	}
+
+	opts.fresh = true
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, opts); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err := db.Exec(`SET search_path = ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	for _, tbl := range allTables() {
+		td, _ := tableDefByName(tbl)
+		if got := dumpTable(t, db, td); !reflect.DeepEqual(got, smallStateRows[tbl]) {
+			t.Errorf("table %s:\n got: %#v\nwant: %#v", tbl, got, smallStateRows[tbl])
+		}
+	}
+
+	var leftover bool
+	if err := db.QueryRow(`SELECT EXISTS ( SELECT 42 FROM pg_namespace WHERE nspname = $1 )`, schema+"_loading").Scan(&leftover); err != nil {
+		t.Fatal(err)
+	} else if leftover {
+		t.Error("loading schema still present after a successful run")
+	}
+
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, opts); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected a refusal to overwrite the target schema, got %v", err)
+	}
+}
@@ -35,8 +35,7 @@ func mustAddrID(a address.Address) uint64 {
 	return i
 }
 
-func newFilStateReader(bs ipfsbs.Blockstore) (*stmgr.StateManager, error) {
-	ebs := ephemeralbs.NewEphemeralBlockstore(bs)
+func newFilStateReader(ebs *ephemeralbs.Blockstore) (*stmgr.StateManager, error) {
 	return stmgr.NewStateManager(
 		chainstore.NewChainStore(
 			ebs,
@@ -60,6 +59,20 @@ func blockstoreFromSnapshot(ctx context.Context, workDir string, snapshotFilenam
 		return nil, xerrors.Errorf("unable to open snapshot car at %s: %w", carFile, err)
 	}
 
+	// a CARv2 carries its own index, a sidecar is only needed for the plain CARv1 snapshots
+	ver, err := car.ReadVersion(carFh)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read car version of %s: %w", carFile, err)
+	}
+	carFh.Seek(0, 0) //nolint:errcheck
+	if ver == 2 {
+		roBs, err := carbs.NewReadOnly(carFh, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to construct blockstore from CARv2 %s: %w", carFile, err)
+		}
+		return roBs, nil
+	}
+
 	var idx caridx.Index
 	idxFile := carFile + `.idx`
 	idxFh, err := os.Open(idxFile)
@@ -71,11 +84,14 @@ func blockstoreFromSnapshot(ctx context.Context, workDir string, snapshotFilenam
 
 		log.Printf("generating new index (slow!!!!) at %s", idxFile)
 		idx, err = car.GenerateIndex(carFh)
-		if err != nil {
-			return nil, xerrors.Errorf("car index generation failed: %w", err)
+		if err == nil {
+			_, err = caridx.WriteTo(idx, idxFh)
 		}
-		if _, err := caridx.WriteTo(idx, idxFh); err != nil {
-			return nil, xerrors.Errorf("writing out car index to %s failed: %w", idxFile, err)
+		if err != nil {
+			// an empty or truncated index would break every subsequent run
+			idxFh.Close()      //nolint:errcheck
+			os.Remove(idxFile) //nolint:errcheck
+			return nil, xerrors.Errorf("car index generation to %s failed: %w", idxFile, err)
 		}
 
 		// if I do not do this, NewReadOnly will recognize this is an io.reader, and will
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+)
+
+// verifyRebuild rebuilds the database ( or a subset of its tables ) into a
+// temporary directory and compares the result against an expected file hash
+// and/or a previously generated database, table by table
+func verifyRebuild(ctx context.Context, workDir, srcSnapshot string, tsk lchtypes.TipSetKey, opts parseOpts, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	tableList := fs.String("tables", "", "comma-separated subset of tables to rebuild and compare ( default: all of them )")
+	refFile := fs.String("reference", path.Join(workDir, dbName), "previously generated database to compare against, skipped if absent")
+	fs.Parse(args) //nolint:errcheck
+
+	if opts.backend != "sqlite" {
+		return xerrors.New("verification is only possible with the sqlite backend")
+	}
+
+	tables := allTables()
+	if *tableList != "" {
+		if opts.expectSha256 != "" {
+			return xerrors.New("a subset of tables can not be checked against a file hash, use -reference instead")
+		}
+		tables = strings.Split(*tableList, ",")
+		opts.tables = make(map[string]bool, len(tables))
+		for _, t := range tables {
+			if _, known := tableDefByName(t); !known {
+				return xerrors.Errorf("unknown table '%s', available: %s", t, strings.Join(allTables(), ","))
+			}
+			opts.tables[t] = true
+		}
+	}
+
+	haveRef := true
+	if _, err := os.Stat(*refFile); os.IsNotExist(err) {
+		haveRef = false
+	} else if err != nil {
+		return err
+	}
+	if !haveRef && opts.expectSha256 == "" {
+		return xerrors.Errorf("nothing to verify against: reference %s does not exist and no -expect-sha256 given", *refFile)
+	}
+
+	tmpDir, err := os.MkdirTemp(workDir, ".verify_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir) //nolint:errcheck
+
+	opts.outFile = path.Join(tmpDir, dbName)
+	if err := parseStaticData(ctx, workDir, srcSnapshot, tsk, opts); err != nil {
+		return err
+	}
+
+	var failed bool
+
+	if *tableList == "" {
+		got, err := fileSha256(opts.outFile)
+		if err != nil {
+			return err
+		}
+		log.Printf("rebuilt database sha256: %s", got)
+
+		if opts.expectSha256 != "" && got != opts.expectSha256 {
+			// hashes published before the digests table was stored in the file
+			if stripped, err := strippedSha256(opts.outFile); err != nil {
+				return err
+			} else if stripped == opts.expectSha256 {
+				log.Printf("rebuilt database sha256 without its %s table: %s", digestsTable, stripped)
+			} else {
+				failed = true
+				log.Printf("MISMATCH: expected sha256 %s", opts.expectSha256)
+			}
+		}
+		if haveRef {
+			ref, err := fileSha256(*refFile)
+			if err != nil {
+				return err
+			}
+			if got != ref {
+				failed = true
+				log.Printf("MISMATCH: reference %s has sha256 %s", *refFile, ref)
+			}
+		}
+	}
+
+	// per-table digests are always computed: on a file-hash mismatch they show where the difference is
+	got, err := fileTableDigests(ctx, opts.outFile, tables)
+	if err != nil {
+		return err
+	}
+	var ref map[string]tableDigest
+	if haveRef {
+		if ref, err = fileTableDigests(ctx, *refFile, tables); err != nil {
+			return err
+		}
+	}
+
+	var report strings.Builder
+	for _, t := range tables {
+		fmt.Fprintf(&report, "\n% 12s  rebuilt    %s", t, got[t])
+		if ref == nil {
+			continue
+		}
+		fmt.Fprintf(&report, "\n% 12s  reference  %s", "", ref[t])
+		if got[t].String() != ref[t].String() {
+			failed = true
+			report.WriteString("     <== MISMATCH")
+		}
+	}
+	log.Printf("per-table digests:%s\n", report.String())
+
+	if failed {
+		return xerrors.New("FAILED: rebuilt database does not match expectations")
+	}
+	log.Println("PASS: rebuilt database matches expectations")
+	return nil
+}
+
+// subsetBackend drops rows destined to tables outside of the selected subset
+type subsetBackend struct {
+	outputBackend
+	tables map[string]bool
+}
+
+func (b subsetBackend) flush(ctx context.Context, rows []dbRow) error {
+	keep := make([]dbRow, 0, len(rows))
+	for _, r := range rows {
+		if b.tables[procTables[r.proc].table] {
+			keep = append(keep, r)
+		}
+	}
+	return b.outputBackend.flush(ctx, keep)
+}
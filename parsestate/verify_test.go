@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyRebuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tsk := writeFixtureCar(t, dir, "fixture.car", smallState)
+	opts := parseOpts{workers: 2, backend: "sqlite"}
+
+	refFile := filepath.Join(dir, dbName)
+	refOpts := opts
+	refOpts.outFile = refFile
+	if err := parseStaticData(ctx, dir, "fixture.car", tsk, refOpts); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	verify := func(expectSha256 string, args ...string) error {
+		t.Helper()
+		o := opts
+		o.expectSha256 = expectSha256
+		return verifyRebuild(ctx, dir, "fixture.car", tsk, o, append([]string{"-reference", refFile}, args...))
+	}
+	mustFail := func(err error) {
+		t.Helper()
+		if err == nil || !strings.Contains(err.Error(), "FAILED") {
+			t.Fatalf("expected a verification failure, got %v", err)
+		}
+	}
+
+	if err := verify(""); err != nil {
+		t.Fatalf("rebuild against an identical reference: %+v", err)
+	}
+	if err := verify(smallStateSha256); err != nil {
+		t.Fatalf("rebuild against the expected sha256: %+v", err)
+	}
+	if err := verify(smallStateStrippedSha256); err != nil {
+		t.Fatalf("rebuild against the sha256 predating table_digests: %+v", err)
+	}
+	mustFail(verify(strings.Repeat("0", 64)))
+
+	if err := checkSha256(ctx, refFile, smallStateSha256); err != nil {
+		t.Fatalf("-expect-sha256 of the fixture DB: %+v", err)
+	}
+	if err := checkSha256(ctx, refFile, smallStateStrippedSha256); err != nil {
+		t.Fatalf("-expect-sha256 predating table_digests: %+v", err)
+	}
+	if sha, err := fileSha256(refFile); err != nil || sha != smallStateSha256 {
+		t.Fatalf("checking the stripped sha256 modified the fixture DB: %s %v", sha, err)
+	}
+	err := checkSha256(ctx, refFile, strings.Repeat("0", 64))
+	if err == nil || !strings.Contains(err.Error(), "FAILED") || !strings.Contains(err.Error(), "msig_actors  rows:") {
+		t.Fatalf("expected an -expect-sha256 mismatch listing table digests, got %v", err)
+	}
+
+	// tamper with a single table of the reference
+	db, err := sql.Open("sqlite3", refFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE accounts SET balance = '1' WHERE account_id = 103`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mustFail(verify(""))
+	mustFail(verify("", "-tables", "accounts"))
+	if err := verify("", "-tables", "msigs,msig_actors"); err != nil {
+		t.Fatalf("subset not including the tampered table: %+v", err)
+	}
+	// a subset has no file hash to speak of
+	if err := verify(smallStateSha256, "-tables", "msigs"); err == nil {
+		t.Fatal("expected a subset with -expect-sha256 to be refused")
+	}
+}
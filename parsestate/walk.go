@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+
+	filaddr "github.com/filecoin-project/go-address"
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	lchtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// same as builtin.DefaultHamtBitwidth, for every state tree since actors v3
+const stateTreeHamtBitwidth = 5
+
+// how many levels of the state tree HAMT to fan out into separate shards
+// 2 levels yield up to 1024 shards on mainnet, plenty to keep all cores busy
+const actorShardDepth = 2
+
+// actorShard is a contiguous, ordered piece of the state tree HAMT: either a
+// subtree rooted at link, or a bucket of entries stored inline in its parent
+type actorShard struct {
+	link cid.Cid
+	kvs  []*hamt.KV
+}
+
+// actorShards splits the actor HAMT of a state root into pieces, which when
+// walked in the returned order visit actors exactly like StateTree.ForEach
+func actorShards(ctx context.Context, cst ipldcbor.IpldStore, stateRoot cid.Cid) ([]actorShard, error) {
+	var root lchtypes.StateRoot
+	if err := cst.Get(ctx, stateRoot, &root); err != nil {
+		return nil, xerrors.Errorf("unable to load state root %s: %w", stateRoot, err)
+	}
+	if root.Version < lchtypes.StateTreeVersion2 {
+		return nil, xerrors.Errorf("state tree version %d predates actors v3 and is not supported", root.Version)
+	}
+
+	shards := []actorShard{{link: root.Actors}}
+	for d := 0; d < actorShardDepth; d++ {
+		expanded := make([]actorShard, 0, len(shards)<<stateTreeHamtBitwidth)
+		for _, s := range shards {
+			if !s.link.Defined() {
+				expanded = append(expanded, s)
+				continue
+			}
+
+			n, err := hamt.LoadNode(ctx, cst, s.link, hamt.UseTreeBitWidth(stateTreeHamtBitwidth))
+			if err != nil {
+				return nil, xerrors.Errorf("unable to load state tree node %s: %w", s.link, err)
+			}
+			for _, p := range n.Pointers {
+				if p.Link.Defined() {
+					expanded = append(expanded, actorShard{link: p.Link})
+				} else {
+					expanded = append(expanded, actorShard{kvs: p.KVs})
+				}
+			}
+		}
+		shards = expanded
+	}
+
+	return shards, nil
+}
+
+func (s actorShard) forEach(ctx context.Context, cst ipldcbor.IpldStore, cb func(filaddr.Address, *lchtypes.Actor) error) error {
+
+	visit := func(k string, val []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		addr, err := filaddr.NewFromBytes([]byte(k))
+		if err != nil {
+			return xerrors.Errorf("invalid address (%x) found in state tree key: %w", []byte(k), err)
+		}
+
+		var act lchtypes.Actor
+		if err := act.UnmarshalCBOR(bytes.NewReader(val)); err != nil {
+			return xerrors.Errorf("unable to decode actor %s: %w", addr, err)
+		}
+
+		return cb(addr, &act)
+	}
+
+	if !s.link.Defined() {
+		for _, kv := range s.kvs {
+			if err := visit(string(kv.Key), kv.Value.Raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	n, err := hamt.LoadNode(ctx, cst, s.link, hamt.UseTreeBitWidth(stateTreeHamtBitwidth))
+	if err != nil {
+		return xerrors.Errorf("unable to load state tree node %s: %w", s.link, err)
+	}
+	return n.ForEach(ctx, func(k string, val *cbg.Deferred) error {
+		return visit(k, val.Raw)
+	})
+}
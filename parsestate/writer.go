@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// rows are committed in explicit transactions of ( at least ) this many
+// a var only for tests to be able to commit ( and interrupt ) more often
+var writeTxRows = 1 << 18
+
+// only ever set by tests, called after every commit with the amount so far
+var afterCommit func(txs int64)
+
+// dbWriter is the only thing writing to the output backend: all walkers hand
+// it batches of rows through a channel. Every walker produces its rows in a
+// deterministic order and owns its set of tables, so the order in which rows
+// land in any given table never depends on goroutine scheduling.
+type dbWriter struct {
+	backend outputBackend
+	in      chan []dbRow
+
+	started      time.Time
+	rowsWritten  int64
+	txsCommitted int64
+}
+
+func newDbWriter(be outputBackend) *dbWriter {
+	return &dbWriter{
+		backend: be,
+		in:      make(chan []dbRow, 1<<10),
+
+		started: time.Now(),
+	}
+}
+
+// send hands a batch of rows to the writer, the batch must not be reused by the caller
+// A checkpoint row, if any, must come last: it is committed along with the rows before it
+func (w *dbWriter) send(ctx context.Context, rows []dbRow) error {
+	select {
+	case w.in <- rows:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close signals no more rows are coming: run() commits what it has and returns
+func (w *dbWriter) close() { close(w.in) }
+
+func (w *dbWriter) run(ctx context.Context) error {
+	pending := make([]dbRow, 0, writeTxRows+1<<10)
+
+	// only the latest checkpoint of each walker is worth writing out
+	ckpts := make(map[string]dbRow)
+
+	commit := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		dataRows := len(pending)
+		for _, walker := range []string{walkerActors, walkerDeals} {
+			if c, found := ckpts[walker]; found {
+				pending = append(pending, c)
+			}
+		}
+		if err := w.backend.flush(ctx, pending); err != nil {
+			return err
+		}
+		txs := atomic.AddInt64(&w.txsCommitted, 1)
+		atomic.AddInt64(&w.rowsWritten, int64(dataRows))
+		pending = pending[:0]
+		ckpts = make(map[string]dbRow)
+		if afterCommit != nil {
+			afterCommit(txs)
+		}
+		return nil
+	}
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case rows, open := <-w.in:
+			if !open {
+				return commit()
+			}
+
+			for _, r := range rows {
+				if r.proc == procCheckpoint {
+					ckpts[r.args[0].(string)] = r
+				} else {
+					pending = append(pending, r)
+				}
+			}
+			if len(pending) >= writeTxRows {
+				if err := commit(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// throughput returns the amount of committed rows, and the overall rows/s rate
+func (w *dbWriter) throughput() (int64, float64) {
+	rows := atomic.LoadInt64(&w.rowsWritten)
+	return rows, float64(rows) / time.Since(w.started).Seconds()
+}
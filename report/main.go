@@ -0,0 +1,101 @@
+// main is main is main
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+const defaultDb = `data/filstate_2162760.sqlite`
+
+func main() {
+	dbFn := flag.String("db", defaultDb, "state database, after updatevotes ran against it")
+	outFn := flag.String("out", "", "write the CSV report to this file instead of stdout")
+	flag.Parse()
+
+	if err := writeReport(context.Background(), *dbFn, *outFn); err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
+
+// writeReport lists, for every actor with a vote, what it contributes to each group and how it got its vote
+func writeReport(ctx context.Context, dbFn, outFn string) error {
+	db, err := sql.Open("sqlite3", dbFn+"?mode=ro&_timeout=5000")
+	if err != nil {
+		return xerrors.Errorf("failed to open state database %s: %w", dbFn, err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	// the rules updatevotes recorded, older versions only ever tallied with the defaults
+	rules := tally.DefaultRules
+	var haveRules bool
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'tally_rules'`).Scan(&haveRules); err != nil {
+		return err
+	}
+	if haveRules {
+		if rules, err = tally.LoadRules(ctx, db); err != nil {
+			return xerrors.Errorf("unable to read the tally rules of %s: %w", dbFn, err)
+		}
+	} else {
+		log.Printf("no tally_rules table in %s: assuming it was tallied with the default rules", dbFn)
+	}
+
+	cs, err := tally.Contributions(ctx, db, rules)
+	if err != nil {
+		return xerrors.Errorf("unable to compute contributions ( did updatevotes run against %s? ): %w", dbFn, err)
+	}
+
+	var out io.Writer = os.Stdout
+	if outFn != "" {
+		fh, err := os.Create(outFn)
+		if err != nil {
+			return err
+		}
+		defer fh.Close() //nolint:errcheck
+		out = fh
+	}
+
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{
+		"actor_id", "actor_type", "does_accept", "via", "balance_attofil", "deal_bytes_client", "deal_bytes_provider", "sp_raw_bytes_mib",
+		"sp_qa_bytes", "verified_deal_bytes_client", "verified_deal_bytes_provider",
+	}); err != nil {
+		return err
+	}
+	for _, c := range cs {
+		if err := w.Write([]string{
+			strconv.FormatInt(c.ActorID, 10),
+			c.ActorType,
+			strconv.FormatBool(c.DoesAccept),
+			c.Via,
+			c.Balance,
+			strconv.FormatInt(c.DealBytesClient, 10),
+			strconv.FormatInt(c.DealBytesProvider, 10),
+			strconv.FormatInt(c.SpRawBytesMiB, 10),
+			c.SpQaBytes,
+			strconv.FormatInt(c.VerifiedDealBytesClient, 10),
+			strconv.FormatInt(c.VerifiedDealBytesProvider, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	if outFn != "" {
+		log.Printf("wrote contributions of %d voting actors to %s", len(cs), outFn)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package rpcbs
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	blkfmt "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipfsbs "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+)
+
+// ChainAPI is the subset of the lotus FullNode API needed to read chain/state blocks
+type ChainAPI struct {
+	ChainReadObj func(context.Context, cid.Cid) ([]byte, error)
+	ChainHasObj  func(context.Context, cid.Cid) (bool, error)
+}
+
+type rpcbs struct {
+	api      *ChainAPI
+	cacheDir string
+}
+
+var _ ipfsbs.Blockstore = &rpcbs{}
+
+// Dial connects to a lotus node API endpoint, e.g. ws://127.0.0.1:1234/rpc/v1
+// The returned closer shuts down the underlying connection.
+func Dial(ctx context.Context, endpoint, token string) (*ChainAPI, jsonrpc.ClientCloser, error) {
+	hdr := http.Header{}
+	if token != "" {
+		hdr.Set("Authorization", "Bearer "+token)
+	}
+
+	var api ChainAPI
+	closer, err := jsonrpc.NewMergeClient(ctx, endpoint, "Filecoin", []interface{}{&api}, hdr)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("unable to connect to lotus API at %s: %w", endpoint, err)
+	}
+	return &api, closer, nil
+}
+
+// NewRPCBlockstore returns a read-only blockstore fetching everything from a
+// lotus node. Every block is checked against its CID: the node is not trusted
+// any more than a downloaded snapshot is. When cacheDir is not empty blocks are
+// also persisted there, and are not fetched again on reruns. Blocks read back
+// from cacheDir are checked just the same, a corrupt one is dropped and fetched
+// again.
+func NewRPCBlockstore(api *ChainAPI, cacheDir string) (ipfsbs.Blockstore, error) {
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return nil, xerrors.Errorf("unable to create block cache directory %s: %w", cacheDir, err)
+		}
+	}
+	return &rpcbs{api: api, cacheDir: cacheDir}, nil
+}
+
+func (r *rpcbs) cachePath(c cid.Cid) string {
+	k := hex.EncodeToString(c.Hash())
+	return filepath.Join(r.cacheDir, k[len(k)-3:], k)
+}
+
+func (r *rpcbs) fetch(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if r.cacheDir != "" {
+		p := r.cachePath(c)
+		if data, err := os.ReadFile(p); err == nil {
+			if err := verify(c, data); err == nil {
+				return data, nil
+			} else if !xerrors.Is(err, errCorrupt) {
+				return nil, err
+			}
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return nil, xerrors.Errorf("unable to drop corrupt cached block %s: %w", c, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	data, err := r.api.ChainReadObj(ctx, c)
+	if err != nil {
+		// the error text of a missing block varies across lotus versions, ask explicitly
+		if has, hasErr := r.api.ChainHasObj(ctx, c); hasErr == nil && !has {
+			return nil, ipfsbs.ErrNotFound
+		}
+		return nil, xerrors.Errorf("ChainReadObj(%s) failed: %w", c, err)
+	}
+
+	if err := verify(c, data); err != nil {
+		return nil, xerrors.Errorf("lotus node returned %w", err)
+	}
+
+	if r.cacheDir != "" {
+		if err := r.store(c, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+var errCorrupt = xerrors.New("corrupt content")
+
+func verify(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return xerrors.Errorf("unable to rehash block %s: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return xerrors.Errorf("%w for block %s: it hashes to %s", errCorrupt, c, actual)
+	}
+	return nil
+}
+
+// store writes to a temporary file first, a half-written cache entry must never be visible
+func (r *rpcbs) store(c cid.Cid, data []byte) error {
+	p := r.cachePath(c)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return xerrors.Errorf("unable to create block cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp_*")
+	if err != nil {
+		return xerrors.Errorf("unable to cache block %s: %w", c, err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck
+		return xerrors.Errorf("unable to cache block %s: %w", c, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return xerrors.Errorf("unable to cache block %s: %w", c, err)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (r *rpcbs) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if r.cacheDir != "" {
+		if _, err := os.Stat(r.cachePath(c)); err == nil {
+			return true, nil
+		}
+	}
+	return r.api.ChainHasObj(ctx, c)
+}
+
+func (r *rpcbs) Get(ctx context.Context, c cid.Cid) (blkfmt.Block, error) {
+	data, err := r.fetch(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blkfmt.NewBlockWithCid(data, c)
+}
+
+func (r *rpcbs) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	data, err := r.fetch(ctx, c)
+	if err != nil {
+		return -1, err
+	}
+	return len(data), nil
+}
+
+// blocks are always verified, whether fetched or read from the cache
+func (*rpcbs) HashOnRead(bool) {}
+
+func (*rpcbs) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	return nil, xerrors.New("enumerating all blocks of a lotus node is not supported")
+}
+
+func (*rpcbs) Put(context.Context, blkfmt.Block) error {
+	return xerrors.New("the lotus RPC blockstore is read-only")
+}
+
+func (*rpcbs) PutMany(context.Context, []blkfmt.Block) error {
+	return xerrors.New("the lotus RPC blockstore is read-only")
+}
+
+func (*rpcbs) DeleteBlock(context.Context, cid.Cid) error {
+	return xerrors.New("the lotus RPC blockstore is read-only")
+}
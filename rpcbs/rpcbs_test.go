@@ -0,0 +1,203 @@
+package rpcbs
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	blkfmt "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipfsbs "github.com/ipfs/go-ipfs-blockstore"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// stubNode serves blocks out of a CAR, the way lotus serves them out of its chainstore
+type stubNode struct {
+	bs      ipfsbs.Blockstore
+	corrupt map[cid.Cid]bool
+	reads   int
+}
+
+func (s *stubNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	s.reads++
+	b, err := s.bs.Get(ctx, c)
+	if err != nil {
+		return nil, xerrors.Errorf("blockstore: block not found")
+	}
+	if s.corrupt[c] {
+		return append([]byte{0}, b.RawData()...), nil
+	}
+	return b.RawData(), nil
+}
+
+func (s *stubNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	return s.bs.Has(ctx, c)
+}
+
+func fixture(t *testing.T) (string, []blkfmt.Block) {
+	t.Helper()
+
+	var blks []blkfmt.Block
+	for _, s := range []string{"foo", "bar", "baz"} {
+		mh, err := multihash.Sum([]byte(s), multihash.BLAKE2B_MIN+31, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := blkfmt.NewBlockWithCid([]byte(s), cid.NewCidV1(cid.DagCBOR, mh))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, b)
+	}
+
+	carFile := filepath.Join(t.TempDir(), "fixture.car")
+	rw, err := carbs.OpenReadWrite(carFile, []cid.Cid{blks[0].Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.PutMany(context.Background(), blks); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return carFile, blks
+}
+
+func startStub(t *testing.T, carFile string) (*stubNode, *ChainAPI) {
+	t.Helper()
+
+	ro, err := carbs.OpenReadOnly(carFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ro.Close() }) //nolint:errcheck
+
+	stub := &stubNode{bs: ro, corrupt: make(map[cid.Cid]bool)}
+	srv := jsonrpc.NewServer()
+	srv.Register("Filecoin", stub)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	api, closer, err := Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closer)
+
+	return stub, api
+}
+
+func TestRPCBlockstore(t *testing.T) {
+	ctx := context.Background()
+	carFile, blks := fixture(t)
+	stub, api := startStub(t, carFile)
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	bs, err := NewRPCBlockstore(api, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range blks {
+		got, err := bs.Get(ctx, want.Cid())
+		if err != nil {
+			t.Fatalf("get %s: %s", want.Cid(), err)
+		}
+		if string(got.RawData()) != string(want.RawData()) {
+			t.Fatalf("block %s: got %q, want %q", want.Cid(), got.RawData(), want.RawData())
+		}
+		if sz, err := bs.GetSize(ctx, want.Cid()); err != nil || sz != len(want.RawData()) {
+			t.Fatalf("size of %s: got %d ( %v ), want %d", want.Cid(), sz, err, len(want.RawData()))
+		}
+	}
+	if stub.reads != len(blks) {
+		t.Fatalf("expected %d node reads, every block exactly once, got %d", len(blks), stub.reads)
+	}
+
+	// a fresh instance over the same cache needs no node at all
+	cached, err := NewRPCBlockstore(&ChainAPI{}, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range blks {
+		if has, err := cached.Has(ctx, want.Cid()); err != nil || !has {
+			t.Fatalf("cached has %s: %t ( %v )", want.Cid(), has, err)
+		}
+		if _, err := cached.Get(ctx, want.Cid()); err != nil {
+			t.Fatalf("cached get %s: %s", want.Cid(), err)
+		}
+	}
+
+	mh, err := multihash.Sum([]byte("nope"), multihash.BLAKE2B_MIN+31, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := cid.NewCidV1(cid.DagCBOR, mh)
+	if has, err := bs.Has(ctx, missing); err != nil || has {
+		t.Fatalf("has of missing block: %t ( %v )", has, err)
+	}
+	if _, err := bs.Get(ctx, missing); !xerrors.Is(err, ipfsbs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing block, got %v", err)
+	}
+}
+
+func TestRPCBlockstoreRejectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	carFile, blks := fixture(t)
+	stub, api := startStub(t, carFile)
+	stub.corrupt[blks[1].Cid()] = true
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	bs, err := NewRPCBlockstore(api, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bs.Get(ctx, blks[1].Cid()); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("expected corruption error, got %v", err)
+	}
+	if _, err := os.Stat((&rpcbs{cacheDir: cacheDir}).cachePath(blks[1].Cid())); !os.IsNotExist(err) {
+		t.Fatalf("corrupt block must not be cached: %v", err)
+	}
+}
+
+func TestRPCBlockstoreTamperedCache(t *testing.T) {
+	ctx := context.Background()
+	carFile, blks := fixture(t)
+	stub, api := startStub(t, carFile)
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	bs, err := NewRPCBlockstore(api, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := (&rpcbs{cacheDir: cacheDir}).cachePath(blks[0].Cid())
+	if err := os.WriteFile(p, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bs.Get(ctx, blks[0].Cid())
+	if err != nil {
+		t.Fatalf("get over a tampered cache entry: %s", err)
+	}
+	if string(got.RawData()) != string(blks[0].RawData()) {
+		t.Fatalf("block %s: got %q, want %q", blks[0].Cid(), got.RawData(), blks[0].RawData())
+	}
+	if stub.reads != 2 {
+		t.Fatalf("expected the tampered block to be fetched again, got %d node reads", stub.reads)
+	}
+	if data, err := os.ReadFile(p); err != nil || string(data) != string(blks[0].RawData()) {
+		t.Fatalf("cache entry not replaced with the refetched block: %q ( %v )", data, err)
+	}
+}
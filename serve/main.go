@@ -0,0 +1,526 @@
+// main is main is main
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/georgysavva/scany/sqlscan"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// point this at the output of finalizeindexes: per-address lookups are table scans otherwise
+const defaultDb = `data/filstate_2162760.sqlite`
+
+const maxPageSize = 1000
+
+type server struct {
+	db *sql.DB
+
+	// present only after updatevotes ran against the DB
+	haveVotes   bool
+	haveBallots bool
+	// height and message of on-chain ballots, absent when tallied by an older updatevotes
+	haveBallotProvenance bool
+	// exclusions and eligibility_rules, absent when tallied by an older updatevotes
+	haveEligibility bool
+
+	// what the votes were propagated with, and the totals are computed with
+	rules tally.Rules
+
+	totalsMu sync.Mutex
+	totals   map[string]tally.Totals
+}
+
+// the state database holds mainnet ( f-prefixed ) addresses, go-address defaults to testnet
+func init() { filaddr.CurrentNetwork = filaddr.Mainnet }
+
+func main() {
+	dbFn := flag.String("db", defaultDb, "state database, after updatevotes ran against it")
+	listen := flag.String("listen", "127.0.0.1:8080", "address to serve the API on")
+	flag.Parse()
+
+	s, err := newServer(*dbFn)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	log.Printf("serving %s on http://%s/v1/", *dbFn, *listen)
+	log.Fatal((&http.Server{
+		Addr:              *listen,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}).ListenAndServe())
+}
+
+func newServer(dbFn string) (*server, error) {
+	db, err := sql.Open("sqlite3", dbFn+"?mode=ro&_timeout=5000")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open state database %s: %w", dbFn, err)
+	}
+
+	s := &server{db: db, rules: tally.DefaultRules}
+	var tables []string
+	if err := sqlscan.Select(
+		context.Background(),
+		db,
+		&tables,
+		`SELECT name FROM sqlite_master WHERE type = 'table'`,
+	); err != nil {
+		return nil, xerrors.Errorf("unable to list tables of %s: %w", dbFn, err)
+	}
+	var haveExclusions, haveEligibilityRules, haveRules bool
+	for _, t := range tables {
+		switch t {
+		case "votes":
+			s.haveVotes = true
+		case "ballots":
+			s.haveBallots = true
+		case "exclusions":
+			haveExclusions = true
+		case "eligibility_rules":
+			haveEligibilityRules = true
+		case "tally_rules":
+			haveRules = true
+		}
+	}
+	s.haveEligibility = haveExclusions && haveEligibilityRules
+	if !s.haveVotes {
+		log.Printf("no votes table in %s: run updatevotes against it first, serving state only", dbFn)
+	} else if !s.haveEligibility {
+		log.Printf("no exclusions or eligibility_rules table in %s: rerun updatevotes against it to serve totals", dbFn)
+	}
+
+	if s.haveBallots {
+		if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info( 'ballots' ) WHERE name = 'height'`).Scan(&s.haveBallotProvenance); err != nil {
+			return nil, xerrors.Errorf("unable to list the ballots columns of %s: %w", dbFn, err)
+		}
+	}
+
+	if haveRules {
+		if s.rules, err = tally.LoadRules(context.Background(), db); err != nil {
+			return nil, xerrors.Errorf("unable to read the tally rules of %s: %w", dbFn, err)
+		}
+	} else if s.haveVotes {
+		log.Printf("no tally_rules table in %s: assuming it was tallied with the default rules", dbFn)
+	}
+
+	return s, nil
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/totals", s.handleTotals)
+	mux.HandleFunc("/v1/address/", s.handleAddress)
+	mux.HandleFunc("/v1/ballots", s.handleBallots)
+	return mux
+}
+
+type apiError struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		log.Printf("%+v", err)
+	}
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+func (s *server) handleTotals(w http.ResponseWriter, r *http.Request) {
+	if !s.haveVotes {
+		writeError(w, http.StatusNotFound, xerrors.New("no votes in this database"))
+		return
+	}
+	if !s.haveEligibility {
+		writeError(w, http.StatusNotFound, xerrors.New("this database was tallied by an updatevotes predating eligibility rules ( no exclusions or eligibility_rules table ): rerun updatevotes against it"))
+		return
+	}
+
+	// the DB is read-only: compute once, serve forever
+	s.totalsMu.Lock()
+	defer s.totalsMu.Unlock()
+	if s.totals == nil {
+		t, err := tally.Results(r.Context(), s.db, s.rules)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.totals = t
+	}
+	writeJSON(w, http.StatusOK, s.totals)
+}
+
+// resolveActorID accepts ID addresses ( with or without the f0 prefix ) and account robust addresses
+func (s *server) resolveActorID(ctx context.Context, addr string) (int64, error) {
+	if id, err := strconv.ParseInt(addr, 10, 64); err == nil {
+		return id, nil
+	}
+
+	a, err := filaddr.NewFromString(addr)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid address '%s': %w", addr, err)
+	}
+	if a.Protocol() == filaddr.ID {
+		id, err := filaddr.IDFromAddress(a)
+		return int64(id), err
+	}
+
+	var ids []int64
+	if err := sqlscan.Select(ctx, s.db, &ids, `SELECT account_id FROM accounts WHERE account_address = $1`, a.String()); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, errUnknownAddress
+	}
+	return ids[0], nil
+}
+
+var errUnknownAddress = xerrors.New("address not found in state")
+
+type dealSummary struct {
+	Count       int64
+	ActiveCount int64
+	ActiveBytes int64
+}
+
+type actorProfile struct {
+	ActorID         int64
+	RobustAddress   *string `json:",omitempty"`
+	Types           []string
+	Balance         *string `json:",omitempty"`
+	Vote            *voteInfo
+	Provider        *providerInfo `json:",omitempty"`
+	Msig            *msigInfo     `json:",omitempty"`
+	SignerOfMsigs   []int64
+	OwnerOfSps      []int64
+	WorkerOfSps     []int64
+	DealsAsClient   dealSummary
+	DealsAsProvider dealSummary
+}
+
+type voteInfo struct {
+	DoesAccept bool
+	// only set for directly cast votes, inherited ones have no time of their own
+	VoteReceived *time.Time
+	// one of the tally.Via* constants
+	Via string
+}
+
+type providerInfo struct {
+	OwnerID  int64
+	WorkerID int64
+	PowerRaw string
+	PowerQa  string
+}
+
+type msigInfo struct {
+	Threshold int
+	Signers   []int64
+}
+
+// /v1/address/{addr} and /v1/address/{addr}/deals
+func (s *server) handleAddress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/address/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "deals") || parts[0] == "" {
+		writeError(w, http.StatusNotFound, xerrors.Errorf("unknown endpoint %s", r.URL.Path))
+		return
+	}
+
+	id, err := s.resolveActorID(ctx, parts[0])
+	if err == errUnknownAddress {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(parts) == 2 {
+		s.handleDeals(w, r, id)
+		return
+	}
+
+	p, err := s.actorProfile(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(p.Types) == 0 && p.DealsAsClient.Count == 0 && len(p.SignerOfMsigs) == 0 && len(p.OwnerOfSps) == 0 && len(p.WorkerOfSps) == 0 {
+		writeError(w, http.StatusNotFound, errUnknownAddress)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *server) actorProfile(ctx context.Context, id int64) (*actorProfile, error) {
+	p := &actorProfile{
+		ActorID:       id,
+		Types:         []string{},
+		SignerOfMsigs: []int64{},
+		OwnerOfSps:    []int64{},
+		WorkerOfSps:   []int64{},
+	}
+
+	var accts []struct {
+		AccountAddress string
+		Balance        string
+	}
+	if err := sqlscan.Select(ctx, s.db, &accts, `SELECT account_address, balance FROM accounts WHERE account_id = $1`, id); err != nil {
+		return nil, err
+	}
+	if len(accts) > 0 {
+		p.Types = append(p.Types, "account")
+		p.RobustAddress = &accts[0].AccountAddress
+		p.Balance = &accts[0].Balance
+	}
+
+	var msigs []struct {
+		Threshold int
+		Balance   string
+	}
+	if err := sqlscan.Select(ctx, s.db, &msigs, `SELECT threshold, balance FROM msigs WHERE msig_id = $1`, id); err != nil {
+		return nil, err
+	}
+	if len(msigs) > 0 {
+		p.Types = append(p.Types, "msig")
+		p.Balance = &msigs[0].Balance
+		p.Msig = &msigInfo{Threshold: msigs[0].Threshold, Signers: []int64{}}
+		if err := sqlscan.Select(ctx, s.db, &p.Msig.Signers, `SELECT actor_id FROM msig_actors WHERE msig_id = $1 ORDER BY actor_id`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	var sps []struct {
+		providerInfo
+		Balance string
+	}
+	if err := sqlscan.Select(ctx, s.db, &sps, `SELECT owner_id, worker_id, power_raw, power_qa, balance FROM providers WHERE provider_id = $1`, id); err != nil {
+		return nil, err
+	}
+	if len(sps) > 0 {
+		p.Types = append(p.Types, "provider")
+		p.Balance = &sps[0].Balance
+		p.Provider = &sps[0].providerInfo
+	}
+
+	for _, q := range []struct {
+		dst *[]int64
+		sql string
+	}{
+		{&p.SignerOfMsigs, `SELECT msig_id FROM msig_actors WHERE actor_id = $1 ORDER BY msig_id`},
+		{&p.OwnerOfSps, `SELECT provider_id FROM providers WHERE owner_id = $1 ORDER BY provider_id`},
+		{&p.WorkerOfSps, `SELECT provider_id FROM providers WHERE worker_id = $1 ORDER BY provider_id`},
+	} {
+		if err := sqlscan.Select(ctx, s.db, q.dst, q.sql, id); err != nil {
+			return nil, err
+		}
+	}
+
+	activeDealCond := s.rules.DealCond()
+	for _, d := range []struct {
+		dst *dealSummary
+		col string
+	}{
+		{&p.DealsAsClient, "client_id"},
+		{&p.DealsAsProvider, "provider_id"},
+	} {
+		if err := sqlscan.Get(ctx, s.db, d.dst, `
+			SELECT
+					COUNT(*) AS count,
+					COALESCE( SUM( `+activeDealCond+` ), 0 ) AS active_count,
+					COALESCE( SUM( CASE WHEN `+activeDealCond+` THEN piece_size ELSE 0 END ), 0 ) AS active_bytes
+				FROM deals d
+			WHERE `+d.col+` = $1
+		`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.haveVotes {
+		var votes []voteInfo
+		if err := sqlscan.Select(ctx, s.db, &votes, `SELECT does_accept, vote_received, via FROM votes WHERE actor_id = $1`, id); err != nil {
+			return nil, err
+		}
+		if len(votes) > 0 {
+			p.Vote = &votes[0]
+		}
+	}
+
+	return p, nil
+}
+
+type deal struct {
+	DealID                int64
+	ClientID              int64
+	ProviderID            int64
+	PieceCid              string
+	PieceSize             int64
+	IsFilplus             bool
+	StartEpoch            int64
+	EndEpoch              int64
+	SectorActivationEpoch *int64
+	DealSlashEpoch        *int64
+	IsActive              bool
+}
+
+type dealPage struct {
+	Deals []deal
+	// pass as ?after= to get the next page, absent on the last one
+	NextAfter *int64 `json:",omitempty"`
+}
+
+// /v1/address/{addr}/deals?role=client|provider&active=true&after={deal_id}&limit=N
+func (s *server) handleDeals(w http.ResponseWriter, r *http.Request, id int64) {
+	q := r.URL.Query()
+
+	col := "client_id"
+	switch q.Get("role") {
+	case "", "client":
+	case "provider":
+		col = "provider_id"
+	default:
+		writeError(w, http.StatusBadRequest, xerrors.New("role must be one of client or provider"))
+		return
+	}
+
+	limit, after, err := pageParams(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// same filter as the tally
+	activeDealCond := s.rules.DealCond()
+	cond := "TRUE"
+	if q.Get("active") == "true" {
+		cond = activeDealCond
+	}
+
+	page := dealPage{Deals: make([]deal, 0, limit)}
+	if err := sqlscan.Select(r.Context(), s.db, &page.Deals, `
+		SELECT
+				deal_id, client_id, provider_id, piece_cid, piece_size, is_filplus,
+				start_epoch, end_epoch, sector_activation_epoch, deal_slash_epoch,
+				`+activeDealCond+` AS is_active
+			FROM deals d
+		WHERE `+col+` = $1 AND deal_id > $2 AND `+cond+`
+		ORDER BY deal_id
+		LIMIT $3
+	`, id, after, limit); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(page.Deals) == limit {
+		page.NextAfter = &page.Deals[limit-1].DealID
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// pageParams parses the limit and after parameters common to paginated endpoints
+func pageParams(q url.Values) (limit int, after int64, err error) {
+	limit = 100
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, xerrors.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	after = -1
+	if a := q.Get("after"); a != "" {
+		if after, err = strconv.ParseInt(a, 10, 64); err != nil {
+			return 0, 0, xerrors.Errorf("invalid after '%s'", a)
+		}
+	}
+	return limit, after, nil
+}
+
+type ballotRecord struct {
+	// the position in the audit trail, i.e. in processing order
+	Seq           int64
+	SignerAddress string
+	OptionID      int64
+	CreatedAt     time.Time
+	ActorID       *int64
+	Disposition   string
+	// on-chain ballots only
+	Height  *int64  `json:",omitempty"`
+	Message *string `json:",omitempty"`
+}
+
+type ballotPage struct {
+	Ballots []ballotRecord
+	// pass as ?after= to get the next page, absent on the last one
+	NextAfter *int64 `json:",omitempty"`
+}
+
+// /v1/ballots?signer={addr}&disposition={counted,unknown_address,conflicting,duplicate,ignored}&after={seq}&limit=N
+func (s *server) handleBallots(w http.ResponseWriter, r *http.Request) {
+	if !s.haveBallots {
+		writeError(w, http.StatusNotFound, xerrors.New("no ballot audit trail in this database"))
+		return
+	}
+
+	limit, after, err := pageParams(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// updatevotes writes the audit trail in processing order: by created_at, then source order
+	conds := []string{"rowid > $1"}
+	args := []interface{}{after}
+	if sig := r.URL.Query().Get("signer"); sig != "" {
+		args = append(args, sig)
+		conds = append(conds, "signer_address = $"+strconv.Itoa(len(args)))
+	}
+	if d := r.URL.Query().Get("disposition"); d != "" {
+		args = append(args, d)
+		conds = append(conds, "disposition = $"+strconv.Itoa(len(args)))
+	}
+
+	args = append(args, limit)
+
+	provenance := `NULL AS height, NULL AS message`
+	if s.haveBallotProvenance {
+		provenance = `height, message`
+	}
+
+	page := ballotPage{Ballots: make([]ballotRecord, 0, limit)}
+	if err := sqlscan.Select(
+		r.Context(),
+		s.db,
+		&page.Ballots,
+		`SELECT rowid AS seq, signer_address, option_id, created_at, actor_id, disposition, `+provenance+` FROM ballots WHERE `+strings.Join(conds, " AND ")+` ORDER BY rowid LIMIT $`+strconv.Itoa(len(args)),
+		args...,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(page.Ballots) == limit {
+		page.NextAfter = &page.Ballots[limit-1].Seq
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
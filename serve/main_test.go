@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+var stateSchema = []string{
+	`CREATE TABLE deals ( deal_id BIGINT, client_id INTEGER, provider_id INTEGER, piece_cid TEXT, label TEXT, piece_size BIGINT, is_filplus BOOLEAN, price_per_epoch BIGINT, provider_collateral BIGINT, client_collateral BIGINT, start_epoch INTEGER, end_epoch INTEGER, sector_activation_epoch INTEGER, deal_slash_epoch INTEGER )`,
+	`CREATE TABLE providers ( provider_id INTEGER, owner_id INTEGER, worker_id INTEGER, power_raw TEXT, power_qa TEXT, balance TEXT )`,
+	`CREATE TABLE accounts ( account_id INTEGER, account_address TEXT, balance TEXT )`,
+	`CREATE TABLE msigs ( msig_id INTEGER, threshold SMALLINT, balance TEXT )`,
+	`CREATE TABLE msig_actors ( msig_id INTEGER, actor_id INTEGER )`,
+	`INSERT INTO deals VALUES
+		( 1, 100, 300, 'bafy1', '', 10, true, 0, 0, 0, 1, 2162761, 5, NULL ),
+		( 2, 100, 300, 'bafy2', '', 20, false, 0, 0, 0, 1, 2162760, 5, NULL ),
+		( 3, 100, 300, 'bafy3', '', 40, false, 0, 0, 0, 1, 2162761, 5, 6 )`,
+	`INSERT INTO providers VALUES ( 300, 100, 101, '1048576', '2097152', '7000' )`,
+	`INSERT INTO msigs VALUES ( 200, 1, '5000' )`,
+	`INSERT INTO msig_actors VALUES ( 200, 101 )`,
+}
+
+var tallySchema = []string{
+	`CREATE TABLE votes ( actor_id INTEGER NOT NULL UNIQUE, does_accept BOOL NOT NULL, vote_received DATETIME NULL, via TEXT NOT NULL )`,
+	`CREATE TABLE ballots ( signer_address TEXT NOT NULL, option_id INTEGER NOT NULL, created_at DATETIME NOT NULL, actor_id INTEGER NULL, disposition TEXT NOT NULL, height INTEGER NULL, message TEXT NULL )`,
+	`INSERT INTO votes VALUES
+		( 100, true, '2022-09-20 12:00:00', 'ballot' ),
+		( 101, false, '2022-09-20 13:00:00', 'ballot' ),
+		( 200, false, NULL, 'msig_threshold' ),
+		( 300, true, NULL, 'sp_owner' )`,
+}
+
+// a tallied DB: alice is f0100, bob f0101
+func writeDB(t *testing.T, fn string, tallied bool) (alice string) {
+	t.Helper()
+	ctx := context.Background()
+
+	a, err := filaddr.NewSecp256k1Address([]byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := filaddr.NewSecp256k1Address([]byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+	stmts := append(append([]string(nil), stateSchema...), tallySchema...)
+	stmts = append(stmts,
+		`INSERT INTO accounts VALUES ( 100, '`+a.String()+`', '1000000000' ), ( 101, '`+b.String()+`', '2000000000' )`,
+		`INSERT INTO ballots VALUES
+			( '`+a.String()+`', 49, '2022-09-20 12:00:00', 100, 'counted', 2162000, 'bafy2bzace' ),
+			( '`+b.String()+`', 50, '2022-09-20 13:00:00', 101, 'counted', NULL, NULL ),
+			( 'f1nobody', 49, '2022-09-20 14:00:00', NULL, 'unknown_address', NULL, NULL ),
+			( '`+a.String()+`', 50, '2022-09-20 15:00:00', 100, 'conflicting', NULL, NULL )`,
+	)
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	if tallied {
+		if _, err := tally.ApplyEligibility(ctx, db, nil); err != nil {
+			t.Fatal(err)
+		}
+		// not the default: the expired deal 2 carries weight
+		r := tally.DefaultRules
+		r.DealsNotExpired = false
+		if err := tally.SaveRules(ctx, db, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a.String()
+}
+
+func get(t *testing.T, h http.Handler, path string, expStatus int, dst interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code != expStatus {
+		t.Fatalf("GET %s: status %d, expected %d: %s", path, rec.Code, expStatus, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("GET %s: content type %s", path, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), dst); err != nil {
+		t.Fatalf("GET %s: %s", path, err)
+	}
+}
+
+func newTestServer(t *testing.T, tallied bool) (http.Handler, string) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "state.sqlite")
+	alice := writeDB(t, fn, tallied)
+	s, err := newServer(fn)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Cleanup(func() { s.db.Close() }) //nolint:errcheck
+	return s.handler(), alice
+}
+
+func TestTotals(t *testing.T) {
+	h, _ := newTestServer(t, true)
+
+	var totals map[string]tally.Totals
+	get(t, h, "/v1/totals", http.StatusOK, &totals)
+	for _, g := range tally.Groups {
+		if _, found := totals[g]; !found {
+			t.Errorf("group %s missing from totals", g)
+		}
+	}
+	// the rules recorded in the DB apply: the expired deal counts
+	if tot := totals["DealBytesClient"]; tot.Yea != 30 || tot.Nay != 0 || tot.Abstain != 0 {
+		t.Errorf("unexpected DealBytesClient totals %+v", tot)
+	}
+	if tot := totals["DealBytesProvider"]; tot.Yea != 30 {
+		t.Errorf("unexpected DealBytesProvider totals %+v", tot)
+	}
+	if tot := totals["VerifiedDealBytesClient"]; tot.Exact == nil || tot.Exact.Yea.String() != "10" {
+		t.Errorf("unexpected VerifiedDealBytesClient totals %+v", tot)
+	}
+}
+
+func TestTotalsPreEligibility(t *testing.T) {
+	h, _ := newTestServer(t, false)
+
+	var e apiError
+	get(t, h, "/v1/totals", http.StatusNotFound, &e)
+	if !strings.Contains(e.Error, "rerun updatevotes") {
+		t.Errorf("unclear error for a DB lacking eligibility tables: %s", e.Error)
+	}
+}
+
+func TestAddress(t *testing.T) {
+	h, alice := newTestServer(t, true)
+
+	for _, addr := range []string{"f0100", "100", alice} {
+		var p actorProfile
+		get(t, h, "/v1/address/"+addr, http.StatusOK, &p)
+		if p.ActorID != 100 || p.RobustAddress == nil || *p.RobustAddress != alice || !reflect.DeepEqual(p.Types, []string{"account"}) {
+			t.Errorf("%s: unexpected profile %+v", addr, p)
+		}
+		if p.Vote == nil || !p.Vote.DoesAccept || p.Vote.Via != tally.ViaBallot || p.Vote.VoteReceived == nil {
+			t.Errorf("%s: unexpected vote %+v", addr, p.Vote)
+		}
+		if !reflect.DeepEqual(p.OwnerOfSps, []int64{300}) {
+			t.Errorf("%s: unexpected owned SPs %v", addr, p.OwnerOfSps)
+		}
+		if exp := (dealSummary{Count: 3, ActiveCount: 2, ActiveBytes: 30}); p.DealsAsClient != exp {
+			t.Errorf("%s: deals as client %+v, expected %+v", addr, p.DealsAsClient, exp)
+		}
+	}
+
+	var p actorProfile
+	get(t, h, "/v1/address/f0300", http.StatusOK, &p)
+	if p.Provider == nil || p.Provider.OwnerID != 100 || p.Vote == nil || p.Vote.Via != tally.ViaSpOwner || p.DealsAsProvider.ActiveBytes != 30 {
+		t.Errorf("unexpected provider profile %+v", p)
+	}
+	get(t, h, "/v1/address/f0200", http.StatusOK, &p)
+	if p.Msig == nil || !reflect.DeepEqual(p.Msig.Signers, []int64{101}) || p.Vote == nil || p.Vote.DoesAccept {
+		t.Errorf("unexpected msig profile %+v", p)
+	}
+
+	var e apiError
+	get(t, h, "/v1/address/f0999", http.StatusNotFound, &e)
+	get(t, h, "/v1/address/notanaddress", http.StatusBadRequest, &e)
+	get(t, h, "/v1/address/f0100/bogus", http.StatusNotFound, &e)
+}
+
+func TestDeals(t *testing.T) {
+	h, _ := newTestServer(t, true)
+
+	ids := func(pg dealPage) (r []int64) {
+		for _, d := range pg.Deals {
+			r = append(r, d.DealID)
+		}
+		return r
+	}
+
+	var pg dealPage
+	get(t, h, "/v1/address/f0100/deals", http.StatusOK, &pg)
+	if !reflect.DeepEqual(ids(pg), []int64{1, 2, 3}) || pg.NextAfter != nil {
+		t.Errorf("unexpected deals %v, next %v", ids(pg), pg.NextAfter)
+	}
+	if !pg.Deals[1].IsActive || pg.Deals[2].IsActive {
+		t.Errorf("active flags not following the tally rules: %+v", pg.Deals)
+	}
+
+	pg = dealPage{}
+	get(t, h, "/v1/address/f0300/deals?role=provider&active=true&limit=1", http.StatusOK, &pg)
+	if !reflect.DeepEqual(ids(pg), []int64{1}) || pg.NextAfter == nil || *pg.NextAfter != 1 {
+		t.Fatalf("unexpected first page %v, next %v", ids(pg), pg.NextAfter)
+	}
+	pg = dealPage{}
+	get(t, h, "/v1/address/f0300/deals?role=provider&active=true&limit=1&after=1", http.StatusOK, &pg)
+	if !reflect.DeepEqual(ids(pg), []int64{2}) {
+		t.Errorf("unexpected second page %v", ids(pg))
+	}
+
+	var e apiError
+	get(t, h, "/v1/address/f0100/deals?role=notary", http.StatusBadRequest, &e)
+	get(t, h, "/v1/address/f0100/deals?limit=0", http.StatusBadRequest, &e)
+	get(t, h, "/v1/address/f0100/deals?after=x", http.StatusBadRequest, &e)
+}
+
+func TestBallots(t *testing.T) {
+	h, alice := newTestServer(t, true)
+
+	disp := func(pg ballotPage) (r []string) {
+		for _, b := range pg.Ballots {
+			r = append(r, b.Disposition)
+		}
+		return r
+	}
+
+	var pg ballotPage
+	get(t, h, "/v1/ballots?limit=3", http.StatusOK, &pg)
+	if !reflect.DeepEqual(disp(pg), []string{"counted", "counted", "unknown_address"}) || pg.NextAfter == nil {
+		t.Fatalf("unexpected first page %v, next %v", disp(pg), pg.NextAfter)
+	}
+	if b := pg.Ballots[0]; b.Height == nil || *b.Height != 2162000 || b.Message == nil || *b.Message != "bafy2bzace" || pg.Ballots[1].Height != nil {
+		t.Errorf("unexpected ballot provenance %+v", pg.Ballots[:2])
+	}
+	next := *pg.NextAfter
+	pg = ballotPage{}
+	get(t, h, "/v1/ballots?limit=3&after="+strconv.FormatInt(next, 10), http.StatusOK, &pg)
+	if !reflect.DeepEqual(disp(pg), []string{"conflicting"}) || pg.NextAfter != nil {
+		t.Errorf("unexpected last page %v, next %v", disp(pg), pg.NextAfter)
+	}
+
+	pg = ballotPage{}
+	get(t, h, "/v1/ballots?signer="+alice, http.StatusOK, &pg)
+	if !reflect.DeepEqual(disp(pg), []string{"counted", "conflicting"}) {
+		t.Errorf("unexpected ballots of %s: %v", alice, disp(pg))
+	}
+	pg = ballotPage{}
+	get(t, h, "/v1/ballots?disposition=unknown_address", http.StatusOK, &pg)
+	if len(pg.Ballots) != 1 || pg.Ballots[0].SignerAddress != "f1nobody" || pg.Ballots[0].ActorID != nil {
+		t.Errorf("unexpected unknown_address ballots %+v", pg.Ballots)
+	}
+
+	var e apiError
+	get(t, h, "/v1/ballots?limit=100000", http.StatusBadRequest, &e)
+}
@@ -0,0 +1,116 @@
+package tally
+
+import (
+	"context"
+	"sort"
+
+	"github.com/georgysavva/scany/sqlscan"
+	"golang.org/x/xerrors"
+)
+
+// What became of a delegation, as recorded in the delegations table
+const (
+	// the delegator votes with the ballot at the end of the path
+	DelegationApplied = "delegated"
+	// the delegator cast a ballot of its own, which always wins
+	DelegationOwnBallot = "own_ballot"
+	// nobody along the path cast a ballot
+	DelegationNoVote = "no_vote"
+	// the path leads back onto itself before reaching a ballot
+	DelegationCycle = "cycle"
+)
+
+// DelegationOutcome is the resolution of a single delegator
+type DelegationOutcome struct {
+	DelegatorID int64
+	DelegateID  int64
+	// delegator first, the actor whose ballot is used ( if any ) last
+	Path   []int64
+	Vote   *bool
+	Status string
+}
+
+// ResolveDelegations follows every delegator -> delegate chain until an actor
+// with a ballot of its own. Only ballots are considered: delegation is applied
+// before any msig or SP propagation. Outcomes are ordered by delegator ID.
+func ResolveDelegations(delegations map[int64]int64, direct map[int64]bool) []DelegationOutcome {
+
+	outcomes := make([]DelegationOutcome, 0, len(delegations))
+	for delegator, delegate := range delegations {
+		o := DelegationOutcome{DelegatorID: delegator, DelegateID: delegate, Path: []int64{delegator}}
+		if _, hasOwn := direct[delegator]; hasOwn {
+			o.Status = DelegationOwnBallot
+			outcomes = append(outcomes, o)
+			continue
+		}
+
+		seen := map[int64]bool{delegator: true}
+		for cur := delegate; ; {
+			if seen[cur] {
+				o.Status = DelegationCycle
+				break
+			}
+			seen[cur] = true
+			o.Path = append(o.Path, cur)
+
+			if v, found := direct[cur]; found {
+				v := v
+				o.Vote, o.Status = &v, DelegationApplied
+				break
+			}
+			next, delegates := delegations[cur]
+			if !delegates {
+				o.Status = DelegationNoVote
+				break
+			}
+			cur = next
+		}
+		outcomes = append(outcomes, o)
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].DelegatorID < outcomes[j].DelegatorID })
+
+	return outcomes
+}
+
+// Delegate gives delegators the vote of the ballot their delegation path ends
+// at. It expects only votes from ballots to be present, and is to be called
+// before Propagate.
+func Delegate(ctx context.Context, db DB, delegations map[int64]int64) ([]DelegationOutcome, error) {
+	if len(delegations) == 0 {
+		return nil, nil
+	}
+
+	var votes []struct {
+		ActorID    int64
+		DoesAccept bool
+	}
+	if err := sqlscan.Select(ctx, db, &votes, `SELECT actor_id, does_accept FROM votes`); err != nil {
+		return nil, err
+	}
+	direct := make(map[int64]bool, len(votes))
+	for _, v := range votes {
+		direct[v.ActorID] = v.DoesAccept
+	}
+
+	outcomes := ResolveDelegations(delegations, direct)
+	for _, o := range outcomes {
+		if o.Status != DelegationApplied {
+			continue
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			`
+			INSERT INTO votes
+				( actor_id, does_accept, vote_received, via )
+			SELECT $1, does_accept, vote_received, '`+ViaDelegation+`'
+				FROM votes
+			WHERE actor_id = $2
+			`,
+			o.DelegatorID, o.Path[len(o.Path)-1],
+		); err != nil {
+			return nil, xerrors.Errorf("unable to record delegated vote of %d: %w", o.DelegatorID, err)
+		}
+	}
+
+	return outcomes, nil
+}
@@ -0,0 +1,38 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveDelegations(t *testing.T) {
+	yea, nay := true, false
+
+	got := ResolveDelegations(
+		map[int64]int64{
+			100: 101, // straight to a ballot
+			102: 103, // through a delegate without one
+			103: 101,
+			104: 101, // own ballot wins
+			105: 106, // nobody voted
+			107: 108, // cycle
+			108: 107,
+			110: 109,
+		},
+		map[int64]bool{101: false, 104: true, 109: true},
+	)
+
+	want := []DelegationOutcome{
+		{DelegatorID: 100, DelegateID: 101, Path: []int64{100, 101}, Vote: &nay, Status: DelegationApplied},
+		{DelegatorID: 102, DelegateID: 103, Path: []int64{102, 103, 101}, Vote: &nay, Status: DelegationApplied},
+		{DelegatorID: 103, DelegateID: 101, Path: []int64{103, 101}, Vote: &nay, Status: DelegationApplied},
+		{DelegatorID: 104, DelegateID: 101, Path: []int64{104}, Status: DelegationOwnBallot},
+		{DelegatorID: 105, DelegateID: 106, Path: []int64{105, 106}, Status: DelegationNoVote},
+		{DelegatorID: 107, DelegateID: 108, Path: []int64{107, 108}, Status: DelegationCycle},
+		{DelegatorID: 108, DelegateID: 107, Path: []int64{108, 107}, Status: DelegationCycle},
+		{DelegatorID: 110, DelegateID: 109, Path: []int64{110, 109}, Vote: &yea, Status: DelegationApplied},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\n got: %+v\nwant: %+v", got, want)
+	}
+}
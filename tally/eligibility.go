@@ -0,0 +1,214 @@
+package tally
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	filbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/georgysavva/scany/sqlscan"
+	"golang.org/x/xerrors"
+)
+
+// ConsensusMinerMinPower is the mainnet raw power an SP needs to be eligible
+// for block rewards. Faulty sectors are already deducted from the claimed
+// power: an SP with all of its sectors faulty has none.
+const ConsensusMinerMinPower = 10 << 40
+
+// GroupEligibility lists what excludes an actor from a single group. Excluded
+// actors still vote and pass on their vote: only their weight is not counted.
+type GroupEligibility struct {
+	// attoFIL, the balance of the actor the weight belongs to
+	MinBalance *filbig.Int `json:",omitempty"`
+	// bytes, provider based groups only
+	MinRawPower *filbig.Int `json:",omitempty"`
+	// deal based groups only: a filter on deals rather than actors
+	FilPlusOnly bool `json:",omitempty"`
+	// always excluded
+	ExcludeActors []ActorExclusion `json:",omitempty"`
+}
+
+// ActorExclusion is an explicitly excluded actor, e.g. an exchange
+type ActorExclusion struct {
+	ActorID int64
+	Reason  string
+}
+
+// ExclusionUnknownBalance is the reason recorded under MinBalance for actors
+// whose balance is not in the state, rather than pretending it is below it
+const ExclusionUnknownBalance = "unknown_balance"
+
+// Exclusion is a row of the exclusions table
+type Exclusion struct {
+	GroupName string
+	ActorID   int64
+	Reason    string
+}
+
+// Eligibility rules by group name, see Groups
+type Eligibility map[string]GroupEligibility
+
+// the actors each group weighs, along with their balance: NULL when the state
+// does not have it, e.g. for a client that is neither an account nor an msig
+var groupActorsSQL = map[string]string{
+	"BalancesNfil": `
+		SELECT provider_id AS actor_id, balance FROM providers
+			UNION ALL
+		SELECT account_id, balance FROM accounts
+			UNION ALL
+		SELECT msig_id, balance FROM msigs
+	`,
+	"DealBytesProvider":         providerActorsSQL,
+	"SpRawBytesMiB":             providerActorsSQL,
+	"SpQaBytes":                 providerActorsSQL,
+	"VerifiedDealBytesProvider": providerActorsSQL,
+	"DealBytesClient":           clientActorsSQL,
+	"VerifiedDealBytesClient":   clientActorsSQL,
+}
+
+const (
+	providerActorsSQL = `SELECT provider_id AS actor_id, balance FROM providers`
+	clientActorsSQL   = `
+		SELECT DISTINCT d.client_id AS actor_id, COALESCE( a.balance, m.balance ) AS balance
+			FROM deals d
+			LEFT JOIN accounts a ON d.client_id = a.account_id
+			LEFT JOIN msigs m ON d.client_id = m.msig_id
+	`
+)
+
+var providerGroups = map[string]bool{"DealBytesProvider": true, "SpRawBytesMiB": true, "SpQaBytes": true, "VerifiedDealBytesProvider": true}
+
+// the verified ones are Fil+ only to begin with
+var dealGroups = map[string]bool{"DealBytesProvider": true, "DealBytesClient": true}
+
+// Validate rejects unknown groups and rules not applicable to a group
+func (e Eligibility) Validate() error {
+	for g, ge := range e {
+		if _, known := groupActorsSQL[g]; !known {
+			return xerrors.Errorf("unknown group '%s'", g)
+		}
+		if ge.MinRawPower != nil && !providerGroups[g] {
+			return xerrors.Errorf("MinRawPower is not applicable to group %s", g)
+		}
+		if ge.FilPlusOnly && !dealGroups[g] {
+			return xerrors.Errorf("FilPlusOnly is not applicable to group %s", g)
+		}
+		for _, x := range ge.ExcludeActors {
+			if x.Reason == "" {
+				return xerrors.Errorf("exclusion of f0%d from group %s lacks a reason", x.ActorID, g)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyEligibility (re)creates the exclusions and eligibility_rules tables
+// Results consults, and returns the exclusions ordered by group and actor. An
+// actor excluded for several reasons is listed once per reason.
+func ApplyEligibility(ctx context.Context, db DB, e Eligibility) ([]Exclusion, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS exclusions`,
+		`
+		CREATE TABLE exclusions (
+			group_name TEXT NOT NULL,
+			actor_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			UNIQUE( group_name, actor_id, reason )
+		)
+		`,
+		`DROP TABLE IF EXISTS eligibility_rules`,
+		`
+		CREATE TABLE eligibility_rules (
+			group_name TEXT NOT NULL,
+			rule TEXT NOT NULL,
+			UNIQUE( group_name, rule )
+		)
+		`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+
+	var excl []Exclusion
+	for _, g := range Groups {
+		ge, found := e[g]
+		if !found {
+			continue
+		}
+		if ge.FilPlusOnly {
+			if _, err := db.ExecContext(ctx, `INSERT INTO eligibility_rules VALUES ( $1, 'filplus_only' )`, g); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, x := range ge.ExcludeActors {
+			excl = append(excl, Exclusion{g, x.ActorID, x.Reason})
+		}
+
+		if ge.MinBalance != nil {
+			var actors []struct {
+				ActorID int64
+				Balance *string
+			}
+			if err := sqlscan.Select(ctx, db, &actors, groupActorsSQL[g]); err != nil {
+				return nil, err
+			}
+			for _, a := range actors {
+				// no balance to compare: excluded, but not as being below the minimum
+				if a.Balance == nil {
+					excl = append(excl, Exclusion{g, a.ActorID, ExclusionUnknownBalance})
+					continue
+				}
+				bal, err := filbig.FromString(*a.Balance)
+				if err != nil {
+					return nil, xerrors.Errorf("unparseable balance '%s' of f0%d: %w", *a.Balance, a.ActorID, err)
+				}
+				if bal.LessThan(*ge.MinBalance) {
+					excl = append(excl, Exclusion{g, a.ActorID, fmt.Sprintf("balance below %s attoFIL", ge.MinBalance)})
+				}
+			}
+		}
+
+		if ge.MinRawPower != nil {
+			var providers []struct {
+				ProviderID int64
+				PowerRaw   string
+			}
+			if err := sqlscan.Select(ctx, db, &providers, `SELECT provider_id, power_raw FROM providers`); err != nil {
+				return nil, err
+			}
+			for _, p := range providers {
+				pow, err := filbig.FromString(p.PowerRaw)
+				if err != nil {
+					return nil, xerrors.Errorf("unparseable raw power '%s' of f0%d: %w", p.PowerRaw, p.ProviderID, err)
+				}
+				if pow.LessThan(*ge.MinRawPower) {
+					excl = append(excl, Exclusion{g, p.ProviderID, fmt.Sprintf("raw power below %s bytes", ge.MinRawPower)})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(excl, func(i, j int) bool {
+		if excl[i].GroupName != excl[j].GroupName {
+			return excl[i].GroupName < excl[j].GroupName
+		}
+		return excl[i].ActorID < excl[j].ActorID
+	})
+	for _, x := range excl {
+		if _, err := db.ExecContext(
+			ctx,
+			`INSERT OR IGNORE INTO exclusions VALUES ( $1, $2, $3 )`,
+			x.GroupName, x.ActorID, x.Reason,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return excl, nil
+}
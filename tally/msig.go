@@ -0,0 +1,265 @@
+package tally
+
+import (
+	"sort"
+)
+
+// Precedence between an msig's own ballot and the one inherited from its signers
+const (
+	MsigDirectFirst    = "direct-first"
+	MsigInheritedFirst = "inherited-first"
+)
+
+// What became of an msig during resolution, as recorded in the msig_resolution table
+const (
+	// enough signers agreed, the msig votes with them
+	MsigInherited = "inherited"
+	// the msig cast its own ballot, the signers either agree or are not decisive
+	MsigDirect = "direct"
+	// the signers reached a decision contradicting the msig's own ballot, Rules.MsigPrecedence picks the winner
+	MsigConflict = "conflict"
+	// both options reached the threshold: deadlocked, no vote
+	MsigSplit = "split"
+	// some signers voted, but no option reached the threshold: no vote
+	MsigShort = "short"
+	// never inherits, see Rules.ExcludeLdnMsig
+	MsigExcluded = "excluded"
+)
+
+// Msig is a node of the signer graph
+type Msig struct {
+	Threshold int
+	Signers   []int64
+}
+
+// MsigOutcome is the resolution of a single msig, one of the Msig* statuses
+type MsigOutcome struct {
+	MsigID    int64
+	Threshold int
+	// signers holding a ( possibly itself inherited ) vote
+	YeaSigners int
+	NaySigners int
+	OwnBallot  *bool
+	Vote       *bool
+	Status     string
+	// the msig is ( transitively ) one of its own signers
+	InCycle bool
+}
+
+// Deadlocked is true for msigs which can not get a vote no matter how long one waits
+func (o MsigOutcome) Deadlocked() bool {
+	return o.Status == MsigSplit || (o.InCycle && o.Vote == nil)
+}
+
+// ResolveMsigs computes the vote of every msig from the votes of its signers,
+// given the direct votes ( ballots ) of all actors. Msigs are evaluated after
+// all of their signers are final: the result does not depend on evaluation
+// order. Cycles are resolved in rounds, each assigning every cycle member that
+// became decisive in the previous one. Outcomes are returned for every msig
+// with at least one voting signer or an own ballot, ordered by msig ID.
+func ResolveMsigs(msigs map[int64]Msig, direct map[int64]bool, rules Rules) []MsigOutcome {
+
+	votes := make(map[int64]bool, len(direct)+len(msigs))
+	for a, v := range direct {
+		votes[a] = v
+	}
+
+	count := func(id int64) (yea, nay int) {
+		for _, s := range msigs[id].Signers {
+			if v, found := votes[s]; !found {
+				continue
+			} else if v {
+				yea++
+			} else {
+				nay++
+			}
+		}
+		return yea, nay
+	}
+	// the signer counts an msig's vote was decided on: within a cycle these
+	// can differ from the final ones, reports must reflect the former
+	decidedOn := make(map[int64][2]int)
+	decide := func(id int64) (v bool, decisive bool) {
+		yea, nay := count(id)
+		v, decisive = verdict(yea, nay, msigs[id].Threshold)
+		if decisive {
+			decidedOn[id] = [2]int{yea, nay}
+		}
+		return v, decisive
+	}
+	eligible := func(id int64) bool {
+		if rules.ExcludeLdnMsig && id == LdnMsigID {
+			return false
+		}
+		_, hasOwn := direct[id]
+		return !hasOwn || rules.MsigPrecedence == MsigInheritedFirst
+	}
+
+	inCycle := make(map[int64]bool)
+	for _, scc := range msigSCCs(msigs) {
+		if len(scc) == 1 && !selfSigner(msigs, scc[0]) {
+			if v, decisive := decide(scc[0]); decisive && eligible(scc[0]) {
+				votes[scc[0]] = v
+			}
+			continue
+		}
+
+		// rounds: decisions within a round only see the previous rounds, and
+		// every member inherits at most once, so that opposing own ballots
+		// within a cycle can not flip each other forever
+		inherited := make(map[int64]bool, len(scc))
+		for _, id := range scc {
+			inCycle[id] = true
+		}
+		for {
+			round := make(map[int64]bool)
+			for _, id := range scc {
+				if inherited[id] || !eligible(id) {
+					continue
+				}
+				if v, decisive := decide(id); decisive {
+					round[id] = v
+				}
+			}
+			if len(round) == 0 {
+				break
+			}
+			for id, v := range round {
+				votes[id] = v
+				inherited[id] = true
+			}
+		}
+	}
+
+	outcomes := make([]MsigOutcome, 0, 1<<10)
+	for id, m := range msigs {
+		o := MsigOutcome{MsigID: id, Threshold: m.Threshold, InCycle: inCycle[id]}
+		if c, found := decidedOn[id]; found {
+			o.YeaSigners, o.NaySigners = c[0], c[1]
+		} else {
+			o.YeaSigners, o.NaySigners = count(id)
+		}
+		if v, found := direct[id]; found {
+			v := v
+			o.OwnBallot = &v
+		}
+		if o.YeaSigners+o.NaySigners == 0 && o.OwnBallot == nil {
+			continue
+		}
+		if v, found := votes[id]; found {
+			v := v
+			o.Vote = &v
+		}
+
+		inherited, decisive := verdict(o.YeaSigners, o.NaySigners, m.Threshold)
+		thr := m.Threshold
+		switch {
+		case rules.ExcludeLdnMsig && id == LdnMsigID:
+			o.Status = MsigExcluded
+		case o.OwnBallot != nil && decisive && inherited != *o.OwnBallot:
+			o.Status = MsigConflict
+		case o.OwnBallot != nil:
+			o.Status = MsigDirect
+		case decisive:
+			o.Status = MsigInherited
+		case o.YeaSigners > 0 && o.NaySigners > 0 && o.YeaSigners >= thr && o.NaySigners >= thr:
+			o.Status = MsigSplit
+		default:
+			o.Status = MsigShort
+		}
+		outcomes = append(outcomes, o)
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].MsigID < outcomes[j].MsigID })
+
+	return outcomes
+}
+
+// the inherited vote, if exactly one option reached the threshold
+func verdict(yea, nay, threshold int) (v bool, decisive bool) {
+	yeaOk, nayOk := yea > 0 && yea >= threshold, nay > 0 && nay >= threshold
+	return yeaOk, yeaOk != nayOk
+}
+
+func selfSigner(msigs map[int64]Msig, id int64) bool {
+	for _, s := range msigs[id].Signers {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// msigSCCs returns the strongly connected components of the msig -> signing
+// msig graph, every component listed after all components it depends on
+// ( Tarjan, iterative: arbitrarily deep nesting can not exhaust the stack )
+func msigSCCs(msigs map[int64]Msig) [][]int64 {
+	ids := make([]int64, 0, len(msigs))
+	for id := range msigs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	index := make(map[int64]int, len(msigs))
+	low := make(map[int64]int, len(msigs))
+	onStack := make(map[int64]bool)
+	var stack []int64
+	var sccs [][]int64
+
+	type frame struct {
+		id   int64
+		next int
+	}
+	for _, root := range ids {
+		if _, seen := index[root]; seen {
+			continue
+		}
+		index[root], low[root] = len(index), len(index)
+		stack, onStack[root] = append(stack, root), true
+		call := []frame{{id: root}}
+
+		for len(call) > 0 {
+			f := &call[len(call)-1]
+			signers := msigs[f.id].Signers
+			if f.next < len(signers) {
+				s := signers[f.next]
+				f.next++
+				if _, isMsig := msigs[s]; !isMsig {
+					continue
+				}
+				if _, seen := index[s]; !seen {
+					index[s], low[s] = len(index), len(index)
+					stack, onStack[s] = append(stack, s), true
+					call = append(call, frame{id: s})
+				} else if onStack[s] && index[s] < low[f.id] {
+					low[f.id] = index[s]
+				}
+				continue
+			}
+
+			id := f.id
+			call = call[:len(call)-1]
+			if len(call) > 0 {
+				if p := call[len(call)-1].id; low[id] < low[p] {
+					low[p] = low[id]
+				}
+			}
+			if low[id] != index[id] {
+				continue
+			}
+			var scc []int64
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				scc = append(scc, top)
+				if top == id {
+					break
+				}
+			}
+			sort.Slice(scc, func(i, j int) bool { return scc[i] < scc[j] })
+			sccs = append(sccs, scc)
+		}
+	}
+
+	return sccs
+}
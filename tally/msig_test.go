@@ -0,0 +1,92 @@
+package tally
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveMsigs(t *testing.T) {
+	yea, nay := true, false
+	inheritedFirst := DefaultRules
+	inheritedFirst.MsigPrecedence = MsigInheritedFirst
+
+	for _, tc := range []struct {
+		name   string
+		msigs  map[int64]Msig
+		direct map[int64]bool
+		rules  Rules
+		want   []MsigOutcome
+	}{
+		{
+			name:   "own ballot trumps signers by default",
+			msigs:  map[int64]Msig{200: {2, []int64{100, 101}}},
+			direct: map[int64]bool{100: true, 101: true, 200: false},
+			rules:  DefaultRules,
+			want:   []MsigOutcome{{MsigID: 200, Threshold: 2, YeaSigners: 2, OwnBallot: &nay, Vote: &nay, Status: MsigConflict}},
+		},
+		{
+			name:   "signers trump own ballot when inherited-first",
+			msigs:  map[int64]Msig{200: {2, []int64{100, 101}}},
+			direct: map[int64]bool{100: true, 101: true, 200: false},
+			rules:  inheritedFirst,
+			want:   []MsigOutcome{{MsigID: 200, Threshold: 2, YeaSigners: 2, OwnBallot: &nay, Vote: &yea, Status: MsigConflict}},
+		},
+		{
+			name:   "LDN msig never inherits",
+			msigs:  map[int64]Msig{LdnMsigID: {1, []int64{100}}},
+			direct: map[int64]bool{100: true},
+			rules:  DefaultRules,
+			want:   []MsigOutcome{{MsigID: LdnMsigID, Threshold: 1, YeaSigners: 1, Status: MsigExcluded}},
+		},
+		{
+			// an iterated fixed point would let 300 inherit from 100 before 200 is known
+			name: "nested msigs are final before their parent is evaluated",
+			msigs: map[int64]Msig{
+				200: {1, []int64{101}},
+				300: {1, []int64{100, 200}},
+			},
+			direct: map[int64]bool{100: true, 101: false},
+			rules:  DefaultRules,
+			want: []MsigOutcome{
+				{MsigID: 200, Threshold: 1, NaySigners: 1, Vote: &nay, Status: MsigInherited},
+				{MsigID: 300, Threshold: 1, YeaSigners: 1, NaySigners: 1, Status: MsigSplit},
+			},
+		},
+		{
+			name: "opposing own ballots within a cycle settle after a single round",
+			msigs: map[int64]Msig{
+				200: {1, []int64{201}},
+				201: {1, []int64{200}},
+			},
+			direct: map[int64]bool{200: true, 201: false},
+			rules:  inheritedFirst,
+			want: []MsigOutcome{
+				{MsigID: 200, Threshold: 1, NaySigners: 1, OwnBallot: &yea, Vote: &nay, Status: MsigConflict, InCycle: true},
+				{MsigID: 201, Threshold: 1, YeaSigners: 1, OwnBallot: &nay, Vote: &yea, Status: MsigConflict, InCycle: true},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ResolveMsigs(tc.msigs, tc.direct, tc.rules); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("\n got: %s\nwant: %s", fmtOutcomes(got), fmtOutcomes(tc.want))
+			}
+		})
+	}
+}
+
+func fmtOutcomes(os []MsigOutcome) string {
+	b := func(v *bool) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	var sb strings.Builder
+	for _, o := range os {
+		fmt.Fprintf(&sb, "\n\t%d %s thr:%d yea:%d nay:%d own:%s vote:%s cycle:%t", o.MsigID, o.Status, o.Threshold, o.YeaSigners, o.NaySigners, b(o.OwnBallot), b(o.Vote), o.InCycle)
+	}
+	return sb.String()
+}
@@ -0,0 +1,113 @@
+package tally
+
+import (
+	"context"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// How an actor came to have a vote, as recorded in votes.via
+const (
+	ViaBallot        = "ballot"
+	ViaDelegation    = "delegation"
+	ViaMsigThreshold = "msig_threshold"
+	ViaSpOwner       = "sp_owner"
+	ViaSpWorker      = "sp_worker"
+)
+
+// Contribution is what a single voting actor adds to each group
+type Contribution struct {
+	ActorID    int64
+	ActorType  string
+	DoesAccept bool
+	Via        string
+	// attoFIL, exact
+	Balance           string
+	DealBytesClient   int64
+	DealBytesProvider int64
+	SpRawBytesMiB     int64 `db:"sp_raw_bytes_mib"`
+	// bytes, exact
+	SpQaBytes                 string
+	VerifiedDealBytesClient   int64
+	VerifiedDealBytesProvider int64
+}
+
+// Contributions lists every actor with a vote, ordered by actor ID. Weights
+// follow rules and the exclusions of ApplyEligibility exactly as Results does:
+// summed up per outcome they make up the Yea and Nay of each group.
+func Contributions(ctx context.Context, db sqlscan.Querier, rules Rules) ([]Contribution, error) {
+	cs := make([]Contribution, 0, 1<<12)
+	if err := sqlscan.Select(ctx, db, &cs, expandSQL(contributionsSQL, rules)); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// deals are aggregated once up front: a per-voter subquery is a full table scan each
+// An actor excluded from a group contributes nothing to it
+const contributionsSQL = `
+WITH
+	active_deals AS (
+		SELECT client_id, provider_id, piece_size, is_filplus
+			FROM deals d
+		WHERE {{dealCond}}
+	),
+	client_bytes AS (
+		SELECT client_id AS actor_id, SUM( piece_size ) AS deal_bytes
+			FROM active_deals d
+		WHERE {{filplus DealBytesClient}}
+		GROUP BY client_id
+	),
+	provider_bytes AS (
+		SELECT provider_id AS actor_id, SUM( piece_size ) AS deal_bytes
+			FROM active_deals d
+		WHERE {{filplus DealBytesProvider}}
+		GROUP BY provider_id
+	),
+	verified_client_bytes AS (
+		SELECT client_id AS actor_id, SUM( piece_size ) AS deal_bytes FROM active_deals d WHERE d.is_filplus GROUP BY client_id
+	),
+	verified_provider_bytes AS (
+		SELECT provider_id AS actor_id, SUM( piece_size ) AS deal_bytes FROM active_deals d WHERE d.is_filplus GROUP BY provider_id
+	)
+SELECT
+		v.actor_id,
+		CASE
+			WHEN a.account_id IS NOT NULL THEN 'account'
+			WHEN m.msig_id IS NOT NULL THEN 'msig'
+			WHEN p.provider_id IS NOT NULL THEN 'provider'
+			ELSE 'unknown'
+		END AS actor_type,
+		v.does_accept,
+		v.via,
+		CASE WHEN {{eligible BalancesNfil v.actor_id}}
+			THEN COALESCE( a.balance, m.balance, p.balance, '0' ) ELSE '0'
+		END AS balance,
+		CASE WHEN {{eligible DealBytesClient v.actor_id}}
+			THEN COALESCE( cb.deal_bytes, 0 ) ELSE 0
+		END AS deal_bytes_client,
+		CASE WHEN {{eligible DealBytesProvider v.actor_id}}
+			THEN COALESCE( pb.deal_bytes, 0 ) ELSE 0
+		END AS deal_bytes_provider,
+		CASE WHEN {{eligible SpRawBytesMiB v.actor_id}}
+			THEN COALESCE( CAST( p.power_raw AS BIGINT ) >> 20, 0 ) ELSE 0
+		END AS sp_raw_bytes_mib,
+		CASE WHEN {{eligible SpQaBytes v.actor_id}}
+			THEN COALESCE( p.power_qa, '0' ) ELSE '0'
+		END AS sp_qa_bytes,
+		CASE WHEN {{eligible VerifiedDealBytesClient v.actor_id}}
+			THEN COALESCE( vcb.deal_bytes, 0 ) ELSE 0
+		END AS verified_deal_bytes_client,
+		CASE WHEN {{eligible VerifiedDealBytesProvider v.actor_id}}
+			THEN COALESCE( vpb.deal_bytes, 0 ) ELSE 0
+		END AS verified_deal_bytes_provider
+	FROM votes v
+	LEFT JOIN accounts a ON a.account_id = v.actor_id
+	LEFT JOIN msigs m ON m.msig_id = v.actor_id
+	LEFT JOIN providers p ON p.provider_id = v.actor_id
+	LEFT JOIN client_bytes cb ON cb.actor_id = v.actor_id
+	LEFT JOIN provider_bytes pb ON pb.actor_id = v.actor_id
+	LEFT JOIN verified_client_bytes vcb ON vcb.actor_id = v.actor_id
+	LEFT JOIN verified_provider_bytes vpb ON vpb.actor_id = v.actor_id
+ORDER BY v.actor_id
+`
@@ -0,0 +1,128 @@
+package tally
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestContributionsMatchResults(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "state.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	for _, s := range []string{
+		`CREATE TABLE deals ( deal_id BIGINT, client_id INTEGER, provider_id INTEGER, piece_size BIGINT, is_filplus BOOLEAN, end_epoch INTEGER, sector_activation_epoch INTEGER, deal_slash_epoch INTEGER )`,
+		`CREATE TABLE providers ( provider_id INTEGER, owner_id INTEGER, worker_id INTEGER, power_raw TEXT, power_qa TEXT, balance TEXT )`,
+		`CREATE TABLE accounts ( account_id INTEGER, account_address TEXT, balance TEXT )`,
+		`CREATE TABLE msigs ( msig_id INTEGER, threshold SMALLINT, balance TEXT )`,
+		`CREATE TABLE votes ( actor_id INTEGER NOT NULL UNIQUE, does_accept BOOL NOT NULL, vote_received DATETIME NULL, via TEXT NOT NULL )`,
+		`INSERT INTO deals VALUES
+			( 1, 100, 300, 10, true, 2162761, 5, NULL ),
+			( 2, 101, 301, 20, false, 2162760, 5, NULL ),
+			( 3, 102, 300, 40, true, 2162761, 5, NULL ),
+			( 4, 100, 301, 80, false, 2162761, 5, 6 )`,
+		`INSERT INTO providers VALUES
+			( 300, 100, 100, '4194304', '41943040', '1000000000' ),
+			( 301, 101, 101, '8388608', '83886080', '2000000000' )`,
+		`INSERT INTO accounts VALUES
+			( 100, 'f1a', '3000000000' ),
+			( 101, 'f1b', '5000000000' ),
+			( 102, 'f1c', '7000000000' ),
+			( 103, 'f1d', '9000000000' )`,
+		`INSERT INTO msigs VALUES ( 200, 1, '4000000000' )`,
+		`INSERT INTO votes VALUES
+			( 100, true, NULL, 'ballot' ),
+			( 101, false, NULL, 'ballot' ),
+			( 102, true, NULL, 'ballot' ),
+			( 200, false, NULL, 'msig_threshold' ),
+			( 300, true, NULL, 'sp_owner' ),
+			( 301, false, NULL, 'sp_owner' )`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	if _, err := ApplyEligibility(ctx, db, Eligibility{
+		"BalancesNfil":            {ExcludeActors: []ActorExclusion{{102, "exchange"}}},
+		"DealBytesClient":         {FilPlusOnly: true},
+		"DealBytesProvider":       {ExcludeActors: []ActorExclusion{{300, "test"}}},
+		"SpRawBytesMiB":           {ExcludeActors: []ActorExclusion{{301, "test"}}},
+		"SpQaBytes":               {ExcludeActors: []ActorExclusion{{300, "test"}}},
+		"VerifiedDealBytesClient": {ExcludeActors: []ActorExclusion{{100, "test"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// not the default: the expired deal 2 carries weight
+	rules := DefaultRules
+	rules.DealsNotExpired = false
+
+	res, err := Results(ctx, db, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := Contributions(ctx, db, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 6 {
+		t.Fatalf("expected 6 voters, got %d", len(cs))
+	}
+
+	sums := make(map[string]Totals)
+	add := func(g string, c Contribution, w float64) {
+		t := sums[g]
+		if c.DoesAccept {
+			t.Yea += w
+		} else {
+			t.Nay += w
+		}
+		sums[g] = t
+	}
+	for _, c := range cs {
+		bal, err := strconv.ParseFloat(c.Balance, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add("BalancesNfil", c, bal/1e9)
+		add("DealBytesClient", c, float64(c.DealBytesClient))
+		add("DealBytesProvider", c, float64(c.DealBytesProvider))
+		add("SpRawBytesMiB", c, float64(c.SpRawBytesMiB))
+		qa, err := strconv.ParseFloat(c.SpQaBytes, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add("SpQaBytes", c, qa)
+		add("VerifiedDealBytesClient", c, float64(c.VerifiedDealBytesClient))
+		add("VerifiedDealBytesProvider", c, float64(c.VerifiedDealBytesProvider))
+	}
+	if len(sums) != len(Groups) {
+		t.Fatalf("contributions cover %d groups, expected all %d", len(sums), len(Groups))
+	}
+	for g, s := range sums {
+		if r := res[g]; r.Yea != s.Yea || r.Nay != s.Nay {
+			t.Errorf("group %s: contributions add up to Yea:%.0f Nay:%.0f, results are Yea:%.0f Nay:%.0f", g, s.Yea, s.Nay, r.Yea, r.Nay)
+		}
+	}
+	if s := sums["DealBytesProvider"]; s.Yea != 0 || s.Nay != 20 {
+		t.Errorf("unexpected DealBytesProvider contributions %+v", s)
+	}
+	if s := sums["DealBytesClient"]; s.Yea != 50 || s.Nay != 0 {
+		t.Errorf("unexpected DealBytesClient contributions %+v", s)
+	}
+	if s := sums["VerifiedDealBytesClient"]; s.Yea != 40 || s.Nay != 0 {
+		t.Errorf("unexpected VerifiedDealBytesClient contributions %+v", s)
+	}
+	if s := sums["SpQaBytes"]; s.Yea != 0 || s.Nay != 83886080 {
+		t.Errorf("unexpected SpQaBytes contributions %+v", s)
+	}
+}
@@ -0,0 +1,247 @@
+package tally
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// the Fil+ LDN msig: its signers are notaries, acting on behalf of clients rather than themselves
+const LdnMsigID = 1858410
+
+// the FilPoll option IDs of FIP-0036, the only ones a ballot can carry
+const (
+	OptionYea = 49
+	OptionNay = 50
+)
+
+// BallotSchemaVersion is the version of the ballot document written by
+// parsestate ballots, the only one updatevotes decodes
+const BallotSchemaVersion = 1
+
+// PollEpoch is the height the state was sampled at
+const PollEpoch = 2162760
+
+// SP vote inheritance, when an SP's owner and worker both voted
+const (
+	SpOwnerFirst  = "owner-first"
+	SpWorkerFirst = "worker-first"
+	// no vote at all when owner and worker disagree
+	SpAgreeOnly = "agree-only"
+)
+
+// Rules are the contested choices of the tally, see RuleVariants
+type Rules struct {
+	SpPrecedence string
+	// msigs get the vote of enough ( >= threshold ) of their signers
+	MsigInheritance bool
+	// MsigDirectFirst or MsigInheritedFirst, for msigs with a ballot of their own
+	MsigPrecedence string
+	ExcludeLdnMsig bool
+	// only count deals with end_epoch > PollEpoch, on top of being active
+	DealsNotExpired bool
+}
+
+// DefaultRules are the ones the preliminary results were published with
+var DefaultRules = Rules{
+	SpPrecedence:    SpOwnerFirst,
+	MsigInheritance: true,
+	MsigPrecedence:  MsigDirectFirst,
+	ExcludeLdnMsig:  true,
+	DealsNotExpired: true,
+}
+
+func (r Rules) String() string {
+	return fmt.Sprintf(
+		"sp:%-12s  msig-inherit:%-5t  msig-precedence:%-15s  exclude-ldn:%-5t  deals-not-expired:%-5t",
+		r.SpPrecedence, r.MsigInheritance, r.MsigPrecedence, r.ExcludeLdnMsig, r.DealsNotExpired,
+	)
+}
+
+// RuleVariants lists every combination of the contested rules, base first,
+// the rest of base ( e.g. MsigPrecedence ) carrying over to every variant
+func RuleVariants(base Rules) []Rules {
+	vs := []Rules{base}
+	for _, sp := range []string{SpOwnerFirst, SpWorkerFirst, SpAgreeOnly} {
+		for _, mi := range []bool{true, false} {
+			for _, ldn := range []bool{true, false} {
+				for _, dne := range []bool{true, false} {
+					r := base
+					r.SpPrecedence, r.MsigInheritance, r.ExcludeLdnMsig, r.DealsNotExpired = sp, mi, ldn, dne
+					// LDN exclusion is moot without msig inheritance
+					if r != base && (mi || ldn) {
+						vs = append(vs, r)
+					}
+				}
+			}
+		}
+	}
+	return vs
+}
+
+// DealCond is the SQL condition selecting the deals that carry weight under
+// r, over a deals table aliased as d
+func (r Rules) DealCond() string {
+	c := `d.sector_activation_epoch IS NOT NULL AND d.deal_slash_epoch IS NULL`
+	if r.DealsNotExpired {
+		c += ` AND d.end_epoch > ` + strconv.Itoa(PollEpoch)
+	}
+	return c
+}
+
+// SaveRules (re)creates the tally_rules table, recording the rules the votes
+// were propagated with: the totals of a tallied DB depend on them as well
+func SaveRules(ctx context.Context, db DB, r Rules) error {
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS tally_rules`,
+		`
+		CREATE TABLE tally_rules (
+			sp_precedence TEXT NOT NULL,
+			msig_inheritance BOOL NOT NULL,
+			msig_precedence TEXT NOT NULL,
+			exclude_ldn_msig BOOL NOT NULL,
+			deals_not_expired BOOL NOT NULL
+		)
+		`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO tally_rules VALUES ( $1, $2, $3, $4, $5 )`,
+		r.SpPrecedence, r.MsigInheritance, r.MsigPrecedence, r.ExcludeLdnMsig, r.DealsNotExpired,
+	)
+	return err
+}
+
+// LoadRules returns the rules recorded by SaveRules
+func LoadRules(ctx context.Context, db sqlscan.Querier) (Rules, error) {
+	var r Rules
+	err := sqlscan.Get(
+		ctx,
+		db,
+		&r,
+		`SELECT sp_precedence, msig_inheritance, msig_precedence, exclude_ldn_msig, deals_not_expired FROM tally_rules`,
+	)
+	return r, err
+}
+
+// DB is satisfied by both *sql.DB and *sql.Tx
+type DB interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Propagate gives msigs and SPs a vote, based on the votes already present:
+// the ones from ballots. It expects no propagated votes to be present yet.
+// The returned outcomes describe every msig with any voting involvement.
+func Propagate(ctx context.Context, db DB, rules Rules) ([]MsigOutcome, error) {
+
+	var outcomes []MsigOutcome
+	if rules.MsigInheritance {
+		var err error
+		if outcomes, err = propagateMsigs(ctx, db, rules); err != nil {
+			return nil, err
+		}
+	}
+
+	// now that we have all the signing actors vote: add the SPs as actors on their own too
+	// When there is a conflict, owner trumps worker ( by default )
+	// An SP already holding a vote got it by delegation, which it keeps
+	// https://filecoinproject.slack.com/archives/C01EU76LPCJ/p1663721692909119
+	first, second, firstVia, secondVia := "owner_vote", "worker_vote", ViaSpOwner, ViaSpWorker
+	if rules.SpPrecedence == SpWorkerFirst {
+		first, second, firstVia, secondVia = second, first, secondVia, firstVia
+	}
+	agreeCond := ""
+	if rules.SpPrecedence == SpAgreeOnly {
+		agreeCond = `AND ( owner_vote IS NULL OR worker_vote IS NULL OR owner_vote = worker_vote )`
+	}
+	_, err := db.ExecContext(
+		ctx,
+		`
+		WITH sp_votes AS (
+			SELECT
+					p.provider_id,
+					( SELECT does_accept FROM votes v WHERE v.actor_id = p.owner_id ) AS owner_vote,
+					( SELECT does_accept FROM votes v WHERE v.actor_id = p.worker_id ) AS worker_vote
+				FROM providers p
+			WHERE p.provider_id NOT IN ( SELECT actor_id FROM votes )
+			)
+		INSERT INTO votes
+			( actor_id, does_accept, via )
+		SELECT
+				provider_id,
+				COALESCE( `+first+`, `+second+` ),
+				CASE WHEN `+first+` IS NOT NULL THEN '`+firstVia+`' ELSE '`+secondVia+`' END
+			FROM sp_votes
+		WHERE COALESCE( owner_vote, worker_vote ) IS NOT NULL
+			`+agreeCond+`
+		`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// give all the msigs a "vote" as well, based on their having-voted parts
+func propagateMsigs(ctx context.Context, db DB, rules Rules) ([]MsigOutcome, error) {
+
+	var ms []struct {
+		MsigID    int64
+		Threshold int
+	}
+	if err := sqlscan.Select(ctx, db, &ms, `SELECT msig_id, threshold FROM msigs`); err != nil {
+		return nil, err
+	}
+	var signers []struct {
+		MsigID  int64
+		ActorID int64
+	}
+	if err := sqlscan.Select(ctx, db, &signers, `SELECT msig_id, actor_id FROM msig_actors ORDER BY msig_id, actor_id`); err != nil {
+		return nil, err
+	}
+	var votes []struct {
+		ActorID    int64
+		DoesAccept bool
+	}
+	if err := sqlscan.Select(ctx, db, &votes, `SELECT actor_id, does_accept FROM votes`); err != nil {
+		return nil, err
+	}
+
+	msigs := make(map[int64]Msig, len(ms))
+	for _, m := range ms {
+		msigs[m.MsigID] = Msig{Threshold: m.Threshold}
+	}
+	for _, s := range signers {
+		m := msigs[s.MsigID]
+		m.Signers = append(m.Signers, s.ActorID)
+		msigs[s.MsigID] = m
+	}
+	direct := make(map[int64]bool, len(votes))
+	for _, v := range votes {
+		direct[v.ActorID] = v.DoesAccept
+	}
+
+	outcomes := ResolveMsigs(msigs, direct, rules)
+	for _, o := range outcomes {
+		if o.Vote == nil || (o.OwnBallot != nil && *o.OwnBallot == *o.Vote) {
+			continue
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			`INSERT OR REPLACE INTO votes ( actor_id, does_accept, via ) VALUES ( $1, $2, $3 )`,
+			o.MsigID, *o.Vote, ViaMsigThreshold,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return outcomes, nil
+}
@@ -0,0 +1,34 @@
+package tally
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleVariants(t *testing.T) {
+	base := DefaultRules
+	base.MsigPrecedence = MsigInheritedFirst
+
+	vs := RuleVariants(base)
+	if vs[0] != base {
+		t.Fatalf("first variant %s, expected the base rules %s", vs[0], base)
+	}
+	// 3 SP choices x 2 deal filters x ( inherit+exclude, inherit, neither ), the base only once
+	if len(vs) != 3*2*3 {
+		t.Errorf("expected %d variants, got %d", 3*2*3, len(vs))
+	}
+	seen := make(map[Rules]bool, len(vs))
+	for _, r := range vs {
+		if seen[r] {
+			t.Errorf("duplicate variant %s", r)
+		}
+		seen[r] = true
+		if r.MsigPrecedence != MsigInheritedFirst {
+			t.Errorf("variant %s lost the msig precedence of the base rules", r)
+		}
+	}
+
+	if s := base.String(); !strings.Contains(s, "msig-precedence:"+MsigInheritedFirst) {
+		t.Errorf("msig precedence missing from %q", s)
+	}
+}
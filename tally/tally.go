@@ -0,0 +1,226 @@
+package tally
+
+import (
+	"context"
+	"math/big"
+	"regexp"
+	"strings"
+
+	filbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/georgysavva/scany/sqlscan"
+	"golang.org/x/xerrors"
+)
+
+// Totals is the weight of a single voting group, split by outcome
+type Totals struct {
+	Abstain float64
+	Yea     float64
+	Nay     float64
+	// only for the groups of exactGroupsSQL, the float fields are rounded from it
+	Exact *ExactTotals `json:",omitempty"`
+}
+
+// ExactTotals are Totals computed without loss of precision
+type ExactTotals struct {
+	Abstain filbig.Int
+	Yea     filbig.Int
+	Nay     filbig.Int
+}
+
+// Groups are listed in the order they are traditionally printed in, the
+// exact ones last
+var Groups = []string{
+	"BalancesNfil",
+	"DealBytesProvider",
+	"DealBytesClient",
+	"SpRawBytesMiB",
+	"SpQaBytes",
+	"VerifiedDealBytesProvider",
+	"VerifiedDealBytesClient",
+}
+
+// Results computes all group totals from the state and votes tables, minus
+// the actors and deals excluded by ApplyEligibility
+func Results(ctx context.Context, db sqlscan.Querier, rules Rules) (map[string]Totals, error) {
+
+	type prelimRes struct {
+		Type       string
+		Weight     float64
+		DoesAccept *bool
+	}
+
+	pr := make([]prelimRes, 0, 8)
+
+	if err := sqlscan.Select(
+		ctx,
+		db,
+		&pr,
+		expandSQL(resultsSQL, rules),
+	); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]Totals, len(Groups))
+	for g, q := range exactGroupsSQL {
+		t, err := exactTotals(ctx, db, expandSQL(q, rules))
+		if err != nil {
+			return nil, xerrors.Errorf("unable to compute group %s: %w", g, err)
+		}
+		res[g] = t
+	}
+	for _, p := range pr {
+		t := res[p.Type]
+		switch {
+		case p.DoesAccept == nil:
+			t.Abstain = p.Weight
+		case *p.DoesAccept:
+			t.Yea = p.Weight
+		default:
+			t.Nay = p.Weight
+		}
+		res[p.Type] = t
+	}
+
+	return res, nil
+}
+
+// exactTotals sums up ( weight, does_accept ) rows, weight being an integer of
+// any size, or its decimal string representation
+func exactTotals(ctx context.Context, db sqlscan.Querier, query string) (Totals, error) {
+	var rows []struct {
+		Weight     string
+		DoesAccept *bool
+	}
+	if err := sqlscan.Select(ctx, db, &rows, query); err != nil {
+		return Totals{}, err
+	}
+
+	e := ExactTotals{Abstain: filbig.Zero(), Yea: filbig.Zero(), Nay: filbig.Zero()}
+	for _, r := range rows {
+		w, err := filbig.FromString(r.Weight)
+		if err != nil {
+			return Totals{}, xerrors.Errorf("unparseable weight '%s': %w", r.Weight, err)
+		}
+		switch {
+		case r.DoesAccept == nil:
+			e.Abstain = filbig.Add(e.Abstain, w)
+		case *r.DoesAccept:
+			e.Yea = filbig.Add(e.Yea, w)
+		default:
+			e.Nay = filbig.Add(e.Nay, w)
+		}
+	}
+
+	toFloat := func(i filbig.Int) float64 {
+		f, _ := new(big.Float).SetInt(i.Int).Float64()
+		return f
+	}
+	return Totals{
+		Abstain: toFloat(e.Abstain),
+		Yea:     toFloat(e.Yea),
+		Nay:     toFloat(e.Nay),
+		Exact:   &e,
+	}, nil
+}
+
+func expandSQL(q string, rules Rules) string {
+	return eligibleRe.ReplaceAllString(
+		filplusRe.ReplaceAllString(
+			strings.ReplaceAll(q, "{{dealCond}}", rules.DealCond()),
+			filplusCond,
+		),
+		eligibleCond,
+	)
+}
+
+// {{eligible Group actor_id_column}} and {{filplus Group}} expand to the
+// conditions of the exclusions and eligibility_rules tables of ApplyEligibility
+var (
+	eligibleRe   = regexp.MustCompile(`\{\{eligible (\w+) ([\w.]+)\}\}`)
+	eligibleCond = `NOT EXISTS ( SELECT 1 FROM exclusions x WHERE x.group_name = '$1' AND x.actor_id = $2 )`
+	filplusRe    = regexp.MustCompile(`\{\{filplus (\w+)\}\}`)
+	filplusCond  = `( d.is_filplus OR NOT EXISTS ( SELECT 1 FROM eligibility_rules r WHERE r.group_name = '$1' AND r.rule = 'filplus_only' ) )`
+)
+
+const resultsSQL = `
+SELECT "BalancesNfil" type, SUM(bal) weight, does_accept FROM (
+	SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
+		FROM providers p
+		LEFT JOIN votes v ON p.provider_id = v.actor_id
+	WHERE {{eligible BalancesNfil p.provider_id}}
+	GROUP BY does_accept
+
+		UNION ALL
+
+	SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
+		FROM accounts a
+		LEFT JOIN votes v ON a.account_id = v.actor_id
+	WHERE {{eligible BalancesNfil a.account_id}}
+	GROUP BY does_accept
+
+		UNION ALL
+
+	SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
+		FROM msigs m
+		LEFT JOIN votes v ON m.msig_id = v.actor_id
+	WHERE {{eligible BalancesNfil m.msig_id}}
+	GROUP BY does_accept
+) GROUP BY does_accept
+
+	UNION ALL
+
+SELECT "DealBytesProvider" type, SUM( piece_size ) weight, does_accept
+	FROM deals d
+	LEFT JOIN votes v ON d.provider_id = v.actor_id
+WHERE {{dealCond}}
+	AND {{filplus DealBytesProvider}}
+	AND {{eligible DealBytesProvider d.provider_id}}
+GROUP BY does_accept
+
+	UNION ALL
+
+SELECT "DealBytesClient" type, SUM( piece_size ) weight, does_accept
+	FROM deals d
+	LEFT JOIN votes v ON d.client_id = v.actor_id
+WHERE {{dealCond}}
+	AND {{filplus DealBytesClient}}
+	AND {{eligible DealBytesClient d.client_id}}
+GROUP BY does_accept
+
+	UNION ALL
+
+SELECT "SpRawBytesMiB" type, SUM( CAST( power_raw AS BIGINT ) >> 20 ) weight, does_accept
+	FROM providers p
+	LEFT JOIN votes v ON p.provider_id = v.actor_id
+WHERE {{eligible SpRawBytesMiB p.provider_id}}
+GROUP BY does_accept
+`
+
+// Deal bytes are summed up per actor in SQL ( exact, an int64 holds any
+// single actor's ) and across actors in Go. Weights are in bytes.
+var exactGroupsSQL = map[string]string{
+	"SpQaBytes": `
+SELECT power_qa AS weight, does_accept
+	FROM providers p
+	LEFT JOIN votes v ON p.provider_id = v.actor_id
+WHERE {{eligible SpQaBytes p.provider_id}}
+`,
+	"VerifiedDealBytesProvider": `
+SELECT SUM( piece_size ) AS weight, does_accept
+	FROM deals d
+	LEFT JOIN votes v ON d.provider_id = v.actor_id
+WHERE {{dealCond}}
+	AND d.is_filplus
+	AND {{eligible VerifiedDealBytesProvider d.provider_id}}
+GROUP BY d.provider_id, does_accept
+`,
+	"VerifiedDealBytesClient": `
+SELECT SUM( piece_size ) AS weight, does_accept
+	FROM deals d
+	LEFT JOIN votes v ON d.client_id = v.actor_id
+WHERE {{dealCond}}
+	AND d.is_filplus
+	AND {{eligible VerifiedDealBytesClient d.client_id}}
+GROUP BY d.client_id, does_accept
+`,
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// the only version of the delegation list understood
+const delegationSchemaVersion = 1
+
+// a delegator votes like its delegate, unless it cast a ballot of its own
+type delegation struct {
+	Delegator filaddr.Address
+	Delegate  filaddr.Address
+}
+
+// loadDelegations reads a curated {"Version":1,"Delegations":[...]} list,
+// decoded strictly just like a versioned ballot document
+func loadDelegations(src string) ([]delegation, error) {
+	raw, err := os.ReadFile(src)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read delegations %s: %w", src, err)
+	}
+
+	var doc struct {
+		Version     int
+		Delegations []delegation
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, xerrors.Errorf("unable to parse delegations %s: %w", src, err)
+	}
+	if doc.Version != delegationSchemaVersion {
+		return nil, xerrors.Errorf("delegations %s are of unsupported version %d, only %d is understood", src, doc.Version, delegationSchemaVersion)
+	}
+
+	var problems []string
+	for i, d := range doc.Delegations {
+		switch {
+		case d.Delegator.Empty() || d.Delegate.Empty():
+			problems = append(problems, fmt.Sprintf("#%d: both Delegator and Delegate are required", i))
+		case d.Delegator == d.Delegate:
+			problems = append(problems, fmt.Sprintf("#%d: %s delegates to itself", i, d.Delegator))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, xerrors.Errorf("%d of %d delegations in %s are invalid:\n\t%s", len(problems), len(doc.Delegations), src, strings.Join(problems, "\n\t"))
+	}
+
+	return doc.Delegations, nil
+}
+
+// applyDelegations resolves the delegations against the votes from ballots,
+// recording every delegation path in the delegations table. Robust addresses
+// must be known accounts, ID addresses may be any actor ( e.g. an msig ).
+func applyDelegations(ctx context.Context, db *sql.DB, delegations []delegation, acctLookup map[filaddr.Address]int) error {
+
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS delegations`,
+		`
+		CREATE TABLE delegations (
+			delegator_id INTEGER NOT NULL UNIQUE,
+			delegate_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			vote BOOL NULL,
+			status TEXT NOT NULL
+		)
+		`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	resolve := func(a filaddr.Address) (int64, error) {
+		if id, found := acctLookup[a]; found {
+			return int64(id), nil
+		}
+		if a.Protocol() == filaddr.ID {
+			id, err := filaddr.IDFromAddress(a)
+			return int64(id), err
+		}
+		return 0, xerrors.Errorf("unknown account address %s", a)
+	}
+	byID := make(map[int64]int64, len(delegations))
+	for _, d := range delegations {
+		from, err := resolve(d.Delegator)
+		if err != nil {
+			return xerrors.Errorf("delegator: %w", err)
+		}
+		to, err := resolve(d.Delegate)
+		if err != nil {
+			return xerrors.Errorf("delegate of %s: %w", d.Delegator, err)
+		}
+		if _, dup := byID[from]; dup {
+			return xerrors.Errorf("f0%d ( %s ) delegates more than once", from, d.Delegator)
+		}
+		byID[from] = to
+	}
+
+	outcomes, err := tally.Delegate(ctx, db, byID)
+	if err != nil {
+		return err
+	}
+
+	var delegated int
+	for _, o := range outcomes {
+		path := make([]string, len(o.Path))
+		for i, id := range o.Path {
+			path[i] = fmt.Sprintf("f0%d", id)
+		}
+		if _, err := db.Exec(
+			`INSERT INTO delegations VALUES ( $1, $2, $3, $4, $5 )`,
+			o.DelegatorID, o.DelegateID, strings.Join(path, " > "), o.Vote, o.Status,
+		); err != nil {
+			return err
+		}
+		if o.Status == tally.DelegationApplied {
+			delegated++
+		} else if o.Status == tally.DelegationCycle {
+			log.Printf("ignoring CYCLIC delegation %s", strings.Join(path, " > "))
+		}
+	}
+	if len(outcomes) > 0 {
+		log.Printf("Applied %d of %d delegations", delegated, len(outcomes))
+	}
+
+	return nil
+}
+
+// delegationsFromDB reloads the delegations applied by the last tally
+func delegationsFromDB(ctx context.Context, db *sql.DB) (map[int64]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT delegator_id, delegate_id FROM delegations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	byID := make(map[int64]int64)
+	for rows.Next() {
+		var from, to int64
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		byID[from] = to
+	}
+	return byID, rows.Err()
+}
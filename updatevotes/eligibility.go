@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	filbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// the only version of the eligibility rules understood
+const eligibilitySchemaVersion = 1
+
+// loadEligibility reads {"Version":1,"ExcludeActors":[...],"Groups":{...}},
+// decoded strictly. ExcludeActors apply to every group, MinRawPower takes
+// either a number of bytes or "consensus" ( see tally.ConsensusMinerMinPower ).
+func loadEligibility(src string) (tally.Eligibility, error) {
+	raw, err := os.ReadFile(src)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read eligibility rules %s: %w", src, err)
+	}
+
+	type groupRules struct {
+		MinBalance    string
+		MinRawPower   string
+		FilPlusOnly   bool
+		ExcludeActors []tally.ActorExclusion
+	}
+	var doc struct {
+		Version       int
+		ExcludeActors []tally.ActorExclusion
+		Groups        map[string]groupRules
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, xerrors.Errorf("unable to parse eligibility rules %s: %w", src, err)
+	}
+	if doc.Version != eligibilitySchemaVersion {
+		return nil, xerrors.Errorf("eligibility rules %s are of unsupported version %d, only %d is understood", src, doc.Version, eligibilitySchemaVersion)
+	}
+
+	e := make(tally.Eligibility, len(tally.Groups))
+	for g, gr := range doc.Groups {
+		ge := tally.GroupEligibility{
+			FilPlusOnly:   gr.FilPlusOnly,
+			ExcludeActors: gr.ExcludeActors,
+		}
+		if gr.MinBalance != "" {
+			b, err := filbig.FromString(gr.MinBalance)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid MinBalance '%s' of group %s: %w", gr.MinBalance, g, err)
+			}
+			ge.MinBalance = &b
+		}
+		if gr.MinRawPower == "consensus" {
+			p := filbig.NewInt(tally.ConsensusMinerMinPower)
+			ge.MinRawPower = &p
+		} else if gr.MinRawPower != "" {
+			p, err := filbig.FromString(gr.MinRawPower)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid MinRawPower '%s' of group %s: %w", gr.MinRawPower, g, err)
+			}
+			ge.MinRawPower = &p
+		}
+		e[g] = ge
+	}
+	if len(doc.ExcludeActors) > 0 {
+		for _, g := range tally.Groups {
+			ge := e[g]
+			ge.ExcludeActors = append(ge.ExcludeActors, doc.ExcludeActors...)
+			e[g] = ge
+		}
+	}
+
+	if err := e.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid eligibility rules %s: %w", src, err)
+	}
+	return e, nil
+}
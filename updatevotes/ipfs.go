@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	unixfsio "github.com/ipfs/go-unixfs/io"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"golang.org/x/xerrors"
+)
+
+// openIpfsBallots resolves ipfs://{cid}[/{path}] from the given CAR alone, no
+// network access whatsoever. Every block read on the way is rehashed: a
+// successful read proves the content is the one addressed by the CID.
+func openIpfsBallots(ctx context.Context, ballotSrc, carFile string) (io.ReadCloser, error) {
+	if carFile == "" {
+		return nil, xerrors.Errorf("a CAR file containing %s is required ( -ballots-car )", ballotSrc)
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(ballotSrc, "ipfs://"), "/"), "/")
+	root, err := cid.Parse(segments[0])
+	if err != nil {
+		return nil, xerrors.Errorf("invalid CID in %s: %w", ballotSrc, err)
+	}
+
+	// just like parsestate's snapshots: carv2 carries its own index, carv1 is indexed in memory
+	bs, err := carbs.OpenReadOnly(carFile)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to open %s: %w", carFile, err)
+	}
+	dserv := merkledag.NewDAGService(blockservice.New(verifyingBlockstore{bs}, nil))
+
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		bs.Close() //nolint:errcheck
+		return nil, xerrors.Errorf("unable to load %s from %s: %w", root, carFile, err)
+	}
+	for _, name := range segments[1:] {
+		dir, err := unixfsio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			bs.Close() //nolint:errcheck
+			return nil, xerrors.Errorf("unable to descend into '%s' of %s: %w", name, ballotSrc, err)
+		}
+		if nd, err = dir.Find(ctx, name); err != nil {
+			bs.Close() //nolint:errcheck
+			return nil, xerrors.Errorf("unable to find '%s' of %s: %w", name, ballotSrc, err)
+		}
+	}
+
+	rdr, err := unixfsio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		bs.Close() //nolint:errcheck
+		return nil, xerrors.Errorf("%s is not a file: %w", ballotSrc, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{rdr, bs}, nil
+}
+
+// the CAR blockstore returns whatever is stored under a CID as-is
+type verifyingBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (vbs verifyingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := vbs.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := c.Prefix().Sum(blk.RawData())
+	if err != nil {
+		return nil, xerrors.Errorf("unable to rehash block %s: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return nil, xerrors.Errorf("CORRUPT block %s: content hashes to %s", c, actual)
+	}
+	return blk, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs"
+	unixfsio "github.com/ipfs/go-unixfs/io"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+)
+
+func TestIpfsBallots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	plainFile := filepath.Join("testdata", "conflicting_ballots", "ballots.json")
+	raw, err := os.ReadFile(plainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := loadBallots(ctx, plainFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory holding a single-block file, the shape of the archived set
+	fileNd := merkledag.NodeWithData(unixfs.FilePBData(raw, uint64(len(raw))))
+	d := unixfsio.NewDirectory(mdtest.Mock())
+	if err := d.AddChild(ctx, "ballots.json", fileNd); err != nil {
+		t.Fatal(err)
+	}
+	dirNd, err := d.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCar := func(name string, blks ...blocks.Block) string {
+		t.Helper()
+		fn := filepath.Join(dir, name)
+		rw, err := carbs.OpenReadWrite(fn, []cid.Cid{dirNd.Cid()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	goodCar := writeCar("good.car", dirNd, fileNd)
+	tampered := strings.Replace(string(raw), `"OptionID": 50`, `"OptionID": 49`, 1)
+	badCar := writeCar("bad.car", dirNd, mustBlockWithCid(t, merkledag.NodeWithData(unixfs.FilePBData([]byte(tampered), uint64(len(tampered)))).RawData(), fileNd.Cid()))
+
+	for _, tc := range []struct {
+		name    string
+		src     string
+		car     string
+		wantErr string
+	}{
+		{"path within a directory", "ipfs://" + dirNd.Cid().String() + "/ballots.json", goodCar, ""},
+		{"file CID", "ipfs://" + fileNd.Cid().String(), goodCar, ""},
+		{"content not matching the CID", "ipfs://" + dirNd.Cid().String() + "/ballots.json", badCar, "CORRUPT block " + fileNd.Cid().String()},
+		{"missing path", "ipfs://" + dirNd.Cid().String() + "/nope.json", goodCar, "unable to find 'nope.json'"},
+		{"no CAR", "ipfs://" + fileNd.Cid().String(), "", "-ballots-car"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := loadBallots(ctx, tc.src, tc.car)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing '%s', got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("\n got: %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+func mustBlockWithCid(t *testing.T, data []byte, c cid.Cid) blocks.Block {
+	t.Helper()
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
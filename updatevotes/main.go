@@ -4,7 +4,8 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -16,6 +17,7 @@ import (
 	filaddr "github.com/filecoin-project/go-address"
 	"github.com/georgysavva/scany/sqlscan"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
 	"golang.org/x/xerrors"
 )
 
@@ -23,23 +25,58 @@ type ballot struct {
 	OptionID      uint64
 	SignerAddress filaddr.Address
 	CreatedAt     time.Time
+	// provenance of on-chain ballots, absent from FilPoll ones
+	Height  *int64
+	Message *string
 }
 
+// what became of a ballot, as recorded in the ballots table
+const (
+	ballotCounted        = "counted"
+	ballotUnknownAddress = "unknown_address"
+	ballotConflicting    = "conflicting"
+	ballotDuplicate      = "duplicate"
+	// an option other than tally.OptionYea or tally.OptionNay
+	ballotIgnored = "ignored"
+)
+
 const (
 	// ballotSource = `https://api.filpoll.io/api/polls/16/view-votes`
 	ballotSource = `https://w3s.link/ipfs/bafybeietprvjsf47sqs2gh7bfkanjbf3nig56jibqfgrijjqxiirgmg3we/fil_fip36_poll_ballots_obtained_morning_of_2022-09-29.json`
 	dbFn         = `data/filstate_2162760.sqlite`
+	// the same set, for use with -ballots-car: offline, and verified against its CID
+	ballotCID = `ipfs://bafybeietprvjsf47sqs2gh7bfkanjbf3nig56jibqfgrijjqxiirgmg3we/fil_fip36_poll_ballots_obtained_morning_of_2022-09-29.json`
 )
 
+// the state database holds mainnet ( f-prefixed ) addresses, go-address defaults to testnet
+func init() { filaddr.CurrentNetwork = filaddr.Mainnet }
+
 func main() {
 	ctx := context.Background()
 
-	if err := updateVotesInDB(ctx, dbFn, ballotSource); err != nil {
+	db := flag.String("db", dbFn, "state database to tally against, e.g. the output of finalizeindexes")
+	msigPrecedence := flag.String("msig-precedence", tally.MsigDirectFirst, "for msigs with a ballot of their own: "+tally.MsigDirectFirst+" or "+tally.MsigInheritedFirst+" ( the vote of enough of its signers wins )")
+	ballotSrc := flag.String("ballots", ballotSource, "ballot JSON to tally: a http(s) URL, a local file, or ipfs://{cid}[/{path}] ( e.g. "+ballotCID+" )")
+	ballotCar := flag.String("ballots-car", "", "CAR file containing the DAG of an ipfs:// -ballots")
+	delegationsSrc := flag.String("delegations", "", "JSON list of delegator => delegate addresses to apply before propagation ( optional )")
+	eligibilitySrc := flag.String("eligibility", "", "JSON eligibility rules per group, excluding actors or deals from the totals ( optional, default: none )")
+	whatIfMode := flag.Bool("what-if", false, "after tallying, re-tally under every combination of the contested rules and print the outcome matrix ( takes about a minute per combination )")
+	flag.Parse()
+
+	rules := tally.DefaultRules
+	switch *msigPrecedence {
+	case tally.MsigDirectFirst, tally.MsigInheritedFirst:
+		rules.MsigPrecedence = *msigPrecedence
+	default:
+		log.Fatalf("unknown -msig-precedence '%s'", *msigPrecedence)
+	}
+
+	if err := updateVotesInDB(ctx, *db, *ballotSrc, *ballotCar, *delegationsSrc, *eligibilitySrc, rules, *whatIfMode); err != nil {
 		log.Fatalf("%+v", err)
 	}
 }
 
-func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
+func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc, ballotCar, delegationsSrc, eligibilitySrc string, rules tally.Rules, whatIfMode bool) error {
 
 	db, err := sql.Open(
 		"sqlite3", dbFn+"?"+strings.Join([]string{
@@ -56,16 +93,132 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 		return xerrors.Errorf("failed to open state database %s: %s", dbFn, err)
 	}
 
-	if _, err := db.Exec(
+	ballots, err := loadBallots(ctx, ballotSrc, ballotCar)
+	if err != nil {
+		return err
+	}
+
+	var delegations []delegation
+	if delegationsSrc != "" {
+		if delegations, err = loadDelegations(delegationsSrc); err != nil {
+			return err
+		}
+	}
+
+	var eligibility tally.Eligibility
+	if eligibilitySrc != "" {
+		if eligibility, err = loadEligibility(eligibilitySrc); err != nil {
+			return err
+		}
+	}
+
+	if err := tallyBallots(ctx, db, ballots, delegations, eligibility, rules); err != nil {
+		return err
+	}
+
+	log.Println("Calculating preliminary results ( takes about a minute )")
+
+	res, err := tally.Results(ctx, db, rules)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range tally.Groups {
+		t := res[g]
+		tot := t.Abstain + t.Yea + t.Nay
+		totVoted := t.Yea + t.Nay
+
+		// exact groups print their exact weight, the percentages are from the floats
+		abstain, yea, nay := fmt.Sprintf("%.0f", t.Abstain), fmt.Sprintf("%.0f", t.Yea), fmt.Sprintf("%.0f", t.Nay)
+		if t.Exact != nil {
+			abstain, yea, nay = t.Exact.Abstain.String(), t.Exact.Yea.String(), t.Exact.Nay.String()
+		}
+
+		log.Printf(`
+
+  Group: %s
+Abstain: %6s %20s
+    Yea: %6s %20s
+    Nay: %6s %20s
+
+`,
+			g,
+			pct(t.Abstain, tot), abstain,
+			pct(t.Yea, totVoted), yea,
+			pct(t.Nay, totVoted), nay,
+		)
+	}
+
+	if whatIfMode {
+		return whatIf(ctx, db, rules)
+	}
+
+	return nil
+}
+
+// pct is part as a percentage of whole, a dash when there is no whole to speak of
+func pct(part, whole float64) string {
+	if whole == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*part/whole)
+}
+
+// tallyBallots (re)creates the votes and ballots tables from scratch: the
+// first ballot of every known signer becomes its vote, which is then
+// delegated, and propagated to msigs and SPs according to rules. Actors not
+// eligible for a group are recorded in the exclusions table.
+func tallyBallots(ctx context.Context, db *sql.DB, ballots []ballot, delegations []delegation, eligibility tally.Eligibility, rules tally.Rules) error {
+
+	// recreated from scratch on every run, older versions lacked the via column
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS votes`,
 		`
-		CREATE TABLE IF NOT EXISTS votes (
+		CREATE TABLE votes (
 			actor_id INTEGER NOT NULL UNIQUE,
 			does_accept BOOL NOT NULL,
-			vote_received DATETIME NULL
+			vote_received DATETIME NULL,
+			via TEXT NOT NULL
 		)
 		`,
-	); err != nil {
-		return err
+	} {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	// the audit trail: every ballot seen, and what became of it
+	// along with every msig with voting signers, and what became of that
+	for _, s := range []string{
+		`DROP TABLE IF EXISTS ballots`,
+		`
+		CREATE TABLE ballots (
+			signer_address TEXT NOT NULL,
+			option_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			actor_id INTEGER NULL,
+			disposition TEXT NOT NULL,
+			height INTEGER NULL,
+			message TEXT NULL
+		)
+		`,
+		`DROP TABLE IF EXISTS msig_resolution`,
+		`
+		CREATE TABLE msig_resolution (
+			msig_id INTEGER NOT NULL UNIQUE,
+			threshold SMALLINT NOT NULL,
+			yea_signers INTEGER NOT NULL,
+			nay_signers INTEGER NOT NULL,
+			own_ballot BOOL NULL,
+			vote BOOL NULL,
+			status TEXT NOT NULL,
+			in_cycle BOOL NOT NULL
+		)
+		`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
 	}
 
 	acctIDs := make([]struct {
@@ -81,44 +234,16 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 		return err
 	}
 	acctLookup := make(map[filaddr.Address]int, len(acctIDs))
+	// on-chain ballots ( parsestate ballots ) are signed by ID addresses: the
+	// chain vouches for those, a FilPoll record merely claiming one does not
+	acctByID := make(map[filaddr.Address]int, len(acctIDs))
 	for _, a := range acctIDs {
 		acctLookup[a.AccountAddress] = a.AccountID
-	}
-
-	var ballotRdr io.ReadCloser
-	defer func() {
-		if ballotRdr != nil {
-			ballotRdr.Close() //nolint:errcheck
-		}
-	}()
-
-	if strings.HasPrefix(ballotSrc, "http://") || strings.HasPrefix(ballotSrc, "https://") {
-		req, err := http.NewRequestWithContext(ctx, "GET", ballotSrc, nil)
-		if err != nil {
-			return err
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			return xerrors.Errorf("non-200 response: %d", resp.StatusCode)
-		}
-
-		ballotRdr = resp.Body
-	} else {
-		ballotRdr, err = os.Open(ballotSrc)
-		if err != nil {
-			return xerrors.Errorf("unable to open %s as plain file: %w", ballotSrc, err)
+		if idAddr, err := filaddr.NewIDAddress(uint64(a.AccountID)); err == nil {
+			acctByID[idAddr] = a.AccountID
 		}
 	}
 
-	ballots := make([]ballot, 0, 1<<12)
-	if err := json.NewDecoder(ballotRdr).Decode(&ballots); err != nil {
-		return xerrors.Errorf("unexpected error parsing data json %s: %w", ballotSrc, err)
-	}
-
 	type vote struct {
 		doesAccept bool
 		received   time.Time
@@ -126,23 +251,36 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 
 	votes := make(map[int]vote, 1<<12)
 
+	type auditEntry struct {
+		ballot
+		actorID     *int
+		disposition string
+	}
+	audit := make([]auditEntry, 0, len(ballots))
+
 	// process ordered by time, first(?) cast wins
-	sort.Slice(ballots, func(i, j int) bool {
+	// stable: identical timestamps are processed in source order
+	sort.SliceStable(ballots, func(i, j int) bool {
 		return ballots[i].CreatedAt.Before(ballots[j].CreatedAt)
 	})
 	for _, b := range ballots {
 		acctID, found := acctLookup[b.SignerAddress]
+		if !found && b.Height != nil {
+			acctID, found = acctByID[b.SignerAddress]
+		}
 		if !found {
-			log.Printf("ignoring ballot %v: unknown robust address", b)
+			log.Printf("ignoring ballot %v: unknown account address", b)
+			audit = append(audit, auditEntry{b, nil, ballotUnknownAddress})
 			continue
 		}
 
-		var doesAccept bool
-		if b.OptionID == 49 {
-			doesAccept = true
-		} else if b.OptionID != 50 {
+		// decodeBallots refuses these, only ever reached with ballots from elsewhere
+		if b.OptionID != tally.OptionYea && b.OptionID != tally.OptionNay {
 			log.Printf("ignoring ballot %v: unknown vote option", b)
+			audit = append(audit, auditEntry{b, &acctID, ballotIgnored})
+			continue
 		}
+		doesAccept := b.OptionID == tally.OptionYea
 
 		if v, exists := votes[acctID]; exists {
 			if v.doesAccept != doesAccept {
@@ -153,7 +291,9 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 					doesAccept,
 					b.CreatedAt,
 				)
-
+				audit = append(audit, auditEntry{b, &acctID, ballotConflicting})
+			} else {
+				audit = append(audit, auditEntry{b, &acctID, ballotDuplicate})
 			}
 			continue
 		}
@@ -162,24 +302,35 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 			doesAccept: doesAccept,
 			received:   b.CreatedAt,
 		}
+		audit = append(audit, auditEntry{b, &acctID, ballotCounted})
 	}
 
 	insertVote, err := db.Prepare(
 		`
 		INSERT INTO votes
-			( actor_id, does_accept, vote_received )
-		VALUES ( $1, $2, $3 )
+			( actor_id, does_accept, vote_received, via )
+		VALUES ( $1, $2, $3, $4 )
 		`,
 	)
 	if err != nil {
 		return err
 	}
 
-	if _, err = db.Exec(
-		`DELETE FROM votes`,
-	); err != nil {
+	insertBallot, err := db.Prepare(
+		`
+		INSERT INTO ballots
+			( signer_address, option_id, created_at, actor_id, disposition, height, message )
+		VALUES ( $1, $2, $3, $4, $5, $6, $7 )
+		`,
+	)
+	if err != nil {
 		return err
 	}
+	for _, a := range audit {
+		if _, err := insertBallot.Exec(a.SignerAddress.String(), a.OptionID, a.CreatedAt, a.actorID, a.disposition, a.Height, a.Message); err != nil {
+			return err
+		}
+	}
 
 	var acceptCount, rejectCount int
 	for a, v := range votes {
@@ -188,183 +339,106 @@ func updateVotesInDB(ctx context.Context, dbFn string, ballotSrc string) error {
 		} else {
 			rejectCount++
 		}
-		if _, err := insertVote.Exec(a, v.doesAccept, v.received); err != nil {
+		if _, err := insertVote.Exec(a, v.doesAccept, v.received, tally.ViaBallot); err != nil {
 			return err
 		}
 	}
 
-	// give all the msigs a "vote" as well, based on their having-voted parts
-	// do it recursively, because why not :)
-	for {
-		res, err := db.Exec(
-			`
-			INSERT INTO votes
-				( actor_id, does_accept )
-			SELECT ma.msig_id, v.does_accept
-				FROM votes v
-				JOIN msig_actors ma USING ( actor_id )
-				JOIN msigs m USING ( msig_id )
-			WHERE
-				ma.msig_id NOT IN ( SELECT actor_id FROM votes )
-					AND
-				ma.msig_id != 1858410 -- ignore the Fil+ LDN msig
-			GROUP BY ma.msig_id, m.threshold, v.does_accept
-			HAVING COUNT(*) >= m.threshold
-			`,
-		)
-		if err != nil {
-			return err
-		}
+	if err := applyDelegations(ctx, db, delegations, acctLookup); err != nil {
+		return err
+	}
 
-		ra, err := res.RowsAffected()
-		if err != nil {
+	msigOutcomes, err := tally.Propagate(ctx, db, rules)
+	if err != nil {
+		return err
+	}
+	for _, o := range msigOutcomes {
+		if _, err := db.Exec(
+			`INSERT INTO msig_resolution VALUES ( $1, $2, $3, $4, $5, $6, $7, $8 )`,
+			o.MsigID, o.Threshold, o.YeaSigners, o.NaySigners, o.OwnBallot, o.Vote, o.Status, o.InCycle,
+		); err != nil {
 			return err
 		}
-
-		if ra == 0 {
-			break
+		if o.Deadlocked() {
+			log.Printf(
+				"DEADLOCKED msig f0%d ( %s, cycle:%t ): %d ACCEPT and %d REJECT signers with a threshold of %d",
+				o.MsigID, o.Status, o.InCycle, o.YeaSigners, o.NaySigners, o.Threshold,
+			)
 		}
 	}
 
-	// now that we have all the signing actors vote: add the SPs as actors on their own too
-	// When there is a conflict, owner trumps worker
-	// https://filecoinproject.slack.com/archives/C01EU76LPCJ/p1663721692909119
-	if _, err := db.Exec(
-		`
-		WITH sp_votes AS (
-			SELECT
-					p.provider_id,
-					COALESCE(
-						( SELECT does_accept FROM votes v WHERE v.actor_id = p.owner_id ),
-						( SELECT does_accept FROM votes v WHERE v.actor_id = p.worker_id )
-					) AS does_accept
-				FROM providers p
-			)
-		INSERT INTO votes
-			( actor_id, does_accept )
-		SELECT provider_id, does_accept FROM sp_votes WHERE does_accept IS NOT NULL
-		`,
-	); err != nil {
+	if err := tally.SaveRules(ctx, db, rules); err != nil {
 		return err
 	}
 
-	log.Printf("Processed %d ACCEPT and %d REJECT votes\n", acceptCount, rejectCount)
-
-	type prelimRes struct {
-		Type       string
-		Weight     float64
-		DoesAccept *bool
+	exclusions, err := tally.ApplyEligibility(ctx, db, eligibility)
+	if err != nil {
+		return err
+	}
+	if len(exclusions) > 0 {
+		// an actor is listed once per reason
+		perGroup := make(map[string]map[int64]bool, len(tally.Groups))
+		for _, x := range exclusions {
+			if perGroup[x.GroupName] == nil {
+				perGroup[x.GroupName] = make(map[int64]bool)
+			}
+			perGroup[x.GroupName][x.ActorID] = true
+		}
+		for _, g := range tally.Groups {
+			if len(perGroup[g]) > 0 {
+				log.Printf("Excluded %d actor(s) from %s, see the exclusions table", len(perGroup[g]), g)
+			}
+		}
 	}
 
-	pr := make([]prelimRes, 0, 8)
+	log.Printf("Processed %d ACCEPT and %d REJECT votes\n", acceptCount, rejectCount)
 
-	log.Println("Calculating preliminary results ( takes about a minute )")
+	return nil
+}
 
-	if err := sqlscan.Select(
-		ctx,
-		db,
-		&pr,
-		`
-		SELECT "BalancesNfil" type, SUM(bal) weight, does_accept FROM (
-			SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
-				FROM providers p
-				LEFT JOIN votes v ON p.provider_id = v.actor_id
-			GROUP BY does_accept
-
-				UNION ALL
-
-			SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
-				FROM accounts a
-				LEFT JOIN votes v ON a.account_id = v.actor_id
-			GROUP BY does_accept
-
-				UNION ALL
-
-			SELECT SUM( CAST( balance AS DOUBLE ) / 1000000000 ) bal, does_accept
-				FROM msigs m
-				LEFT JOIN votes v ON m.msig_id = v.actor_id
-			GROUP BY does_accept
-		) GROUP BY does_accept
-
-			UNION ALL
-
-		SELECT "DealBytesProvider" type, SUM( piece_size ) weight, does_accept
-			FROM deals d
-			LEFT JOIN votes v ON d.provider_id = v.actor_id
-		WHERE
-			d.sector_activation_epoch IS NOT NULL
-				AND
-			d.deal_slash_epoch IS NULL
-				AND
-			d.end_epoch > 2162760
-		GROUP BY does_accept
-
-			UNION ALL
-
-		SELECT "DealBytesClient" type, SUM( piece_size ) weight, does_accept
-			FROM deals d
-			LEFT JOIN votes v ON d.client_id = v.actor_id
-		WHERE
-			d.sector_activation_epoch IS NOT NULL
-				AND
-			d.deal_slash_epoch IS NULL
-				AND
-			d.end_epoch > 2162760
-		GROUP BY does_accept
-
-			UNION ALL
-
-		SELECT "SpRawBytesMiB" type, SUM( CAST( power_raw AS BIGINT ) >> 20 ) weight, does_accept
-			FROM providers p
-			LEFT JOIN votes v ON p.provider_id = v.actor_id
-		GROUP BY does_accept
-		`,
-	); err != nil {
-		return err
-	}
+// loadBallots reads the ballot JSON from either a http(s) URL, a local file or
+// an ipfs:// path within a local CAR, the only case ballotCar is used for
+func loadBallots(ctx context.Context, ballotSrc, ballotCar string) ([]ballot, error) {
 
-	type tslice struct {
-		didVote    bool
-		doesAccept bool
-	}
+	var ballotRdr io.ReadCloser
+	defer func() {
+		if ballotRdr != nil {
+			ballotRdr.Close() //nolint:errcheck
+		}
+	}()
 
-	prelimTally := make(map[string]map[tslice]float64, 4)
-	for _, p := range pr {
+	if strings.HasPrefix(ballotSrc, "http://") || strings.HasPrefix(ballotSrc, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", ballotSrc, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
 
-		t, seen := prelimTally[p.Type]
-		if !seen {
-			t = make(map[tslice]float64, 3)
-			prelimTally[p.Type] = t
+		if resp.StatusCode != http.StatusOK {
+			return nil, xerrors.Errorf("non-200 response: %d", resp.StatusCode)
 		}
 
-		ts := tslice{
-			didVote: (p.DoesAccept != nil),
+		ballotRdr = resp.Body
+	} else if strings.HasPrefix(ballotSrc, "ipfs://") {
+		var err error
+		ballotRdr, err = openIpfsBallots(ctx, ballotSrc, ballotCar)
+		if err != nil {
+			return nil, err
 		}
-		if ts.didVote {
-			ts.doesAccept = *p.DoesAccept
+	} else {
+		var err error
+		ballotRdr, err = os.Open(ballotSrc)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to open %s as plain file: %w", ballotSrc, err)
 		}
-
-		t[ts] = p.Weight
 	}
 
-	for g, t := range prelimTally {
-		tot := t[tslice{didVote: false}] + t[tslice{didVote: true, doesAccept: false}] + t[tslice{didVote: true, doesAccept: true}]
-		totVoted := t[tslice{didVote: true, doesAccept: false}] + t[tslice{didVote: true, doesAccept: true}]
-
-		log.Printf(`
-
-  Group: %s
-Abstain: % 3.1f%% % 20.0f
-    Yea: % 3.1f%% % 20.0f
-    Nay: % 3.1f%% % 20.0f
-
-`,
-			g,
-			100*t[tslice{didVote: false}]/tot, t[tslice{didVote: false}],
-			100*t[tslice{didVote: true, doesAccept: true}]/totVoted, t[tslice{didVote: true, doesAccept: true}],
-			100*t[tslice{didVote: true, doesAccept: false}]/totVoted, t[tslice{didVote: true, doesAccept: false}],
-		)
+	raw, err := io.ReadAll(ballotRdr)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read %s: %w", ballotSrc, err)
 	}
-
-	return nil
+	return decodeBallots(ballotSrc, raw)
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/georgysavva/scany/sqlscan"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/ with the current results")
+
+// the subset of the parsestate schema the tally reads
+var fixtureSchema = []string{
+	`CREATE TABLE deals (
+		deal_id BIGINT NOT NULL UNIQUE,
+		client_id INTEGER NOT NULL,
+		provider_id INTEGER NOT NULL,
+		piece_size BIGINT NOT NULL,
+		is_filplus BOOLEAN NOT NULL,
+		end_epoch INTEGER NOT NULL,
+		sector_activation_epoch INTEGER,
+		deal_slash_epoch INTEGER
+	)`,
+	`CREATE TABLE providers (
+		provider_id INTEGER NOT NULL UNIQUE,
+		owner_id INTEGER NOT NULL,
+		worker_id INTEGER NOT NULL,
+		power_raw TEXT NOT NULL,
+		power_qa TEXT NOT NULL,
+		balance TEXT NOT NULL
+	)`,
+	`CREATE TABLE accounts (
+		account_id INTEGER NOT NULL UNIQUE,
+		account_address TEXT NOT NULL UNIQUE,
+		balance TEXT NOT NULL
+	)`,
+	`CREATE TABLE msigs (
+		msig_id INTEGER NOT NULL UNIQUE,
+		threshold SMALLINT NOT NULL,
+		balance TEXT NOT NULL
+	)`,
+	`CREATE TABLE msig_actors (
+		msig_id INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL,
+		UNIQUE( msig_id, actor_id )
+	)`,
+}
+
+type fixtureState struct {
+	Accounts []struct {
+		ID      int64
+		Address string
+		Balance string
+	}
+	Msigs []struct {
+		ID        int64
+		Threshold int
+		Balance   string
+		Signers   []int64
+	}
+	Providers []struct {
+		ID       int64
+		Owner    int64
+		Worker   int64
+		PowerRaw string
+		// defaults to PowerRaw: no verified deals
+		PowerQa string
+		Balance string
+	}
+	Deals []struct {
+		ID        int64
+		Client    int64
+		Provider  int64
+		PieceSize int64
+		FilPlus   bool
+		EndEpoch  int64
+		// all deals are active unless slashed
+		Slashed *int64
+	}
+}
+
+type goldenResult struct {
+	Votes []struct {
+		ActorID    int64
+		DoesAccept bool
+		Via        string
+	}
+	Ballots []struct {
+		SignerAddress string
+		OptionID      int
+		ActorID       *int64
+		Disposition   string
+		// on-chain ballots only
+		Height  *int64  `json:",omitempty"`
+		Message *string `json:",omitempty"`
+	}
+	MsigResolution []struct {
+		MsigID     int64
+		Threshold  int
+		YeaSigners int
+		NaySigners int
+		OwnBallot  *bool
+		Vote       *bool
+		Status     string
+		InCycle    bool
+	}
+	Delegations []struct {
+		DelegatorID int64
+		DelegateID  int64
+		Path        string
+		Vote        *bool
+		Status      string
+	} `json:",omitempty"`
+	Exclusions []tally.Exclusion `json:",omitempty"`
+	Results    map[string]tally.Totals
+}
+
+func loadFixtureDB(t *testing.T, stateFile string) *sql.DB {
+	t.Helper()
+
+	raw, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fs fixtureState
+	if err := json.Unmarshal(raw, &fs); err != nil {
+		t.Fatalf("%s: %s", stateFile, err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "state.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() }) //nolint:errcheck
+
+	exec := func(q string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(q, args...); err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+	}
+	for _, s := range fixtureSchema {
+		exec(s)
+	}
+	for _, a := range fs.Accounts {
+		exec(`INSERT INTO accounts VALUES ( $1, $2, $3 )`, a.ID, a.Address, a.Balance)
+	}
+	for _, m := range fs.Msigs {
+		exec(`INSERT INTO msigs VALUES ( $1, $2, $3 )`, m.ID, m.Threshold, m.Balance)
+		for _, s := range m.Signers {
+			exec(`INSERT INTO msig_actors VALUES ( $1, $2 )`, m.ID, s)
+		}
+	}
+	for _, p := range fs.Providers {
+		if p.PowerQa == "" {
+			p.PowerQa = p.PowerRaw
+		}
+		exec(`INSERT INTO providers VALUES ( $1, $2, $3, $4, $5, $6 )`, p.ID, p.Owner, p.Worker, p.PowerRaw, p.PowerQa, p.Balance)
+	}
+	for _, d := range fs.Deals {
+		exec(`INSERT INTO deals VALUES ( $1, $2, $3, $4, $5, $6, 1, $7 )`, d.ID, d.Client, d.Provider, d.PieceSize, d.FilPlus, d.EndEpoch, d.Slashed)
+	}
+
+	return db
+}
+
+func TestTallyGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		desc string
+	}{
+		{"nested_msigs", "msigs inherit from msigs over several rounds, the LDN msig never does"},
+		{"ties", "msigs where both or neither option reach the threshold get no vote"},
+		{"msig_cycles", "msigs signing for each other resolve in rounds, undecidable ones are reported deadlocked"},
+		{"conflicting_ballots", "earliest ballot wins, later conflicting and duplicate ones are only audited"},
+		{"owner_worker_disagreement", "owner trumps worker, the worker vote is used only in absence of an owner one"},
+		{"delegation", "delegators vote like the ballot their delegation path ends at, before msig and SP propagation"},
+		{"eligibility", "excluded actors and non-Fil+ deals carry no weight in their group, excluded actors still vote"},
+		{"onchain_ballots", "ID addresses match accounts for ballots from the chain only, FilPoll records claiming one are unknown"},
+		{"provider_delegation", "an SP with a delegated vote keeps it, an SP whose delegation yields none inherits from its owner"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := filepath.Join("testdata", tc.name)
+
+			db := loadFixtureDB(t, filepath.Join(dir, "state.json"))
+			ballots, err := loadBallots(ctx, filepath.Join(dir, "ballots.json"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// delegations and eligibility rules are optional
+			var delegations []delegation
+			if _, err := os.Stat(filepath.Join(dir, "delegations.json")); err == nil {
+				if delegations, err = loadDelegations(filepath.Join(dir, "delegations.json")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var eligibility tally.Eligibility
+			if _, err := os.Stat(filepath.Join(dir, "eligibility.json")); err == nil {
+				if eligibility, err = loadEligibility(filepath.Join(dir, "eligibility.json")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tallyBallots(ctx, db, ballots, delegations, eligibility, tally.DefaultRules); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			var got goldenResult
+			if err := sqlscan.Select(ctx, db, &got.Votes, `SELECT actor_id, does_accept, via FROM votes ORDER BY actor_id`); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlscan.Select(ctx, db, &got.Ballots, `SELECT signer_address, option_id, actor_id, disposition, height, message FROM ballots ORDER BY rowid`); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlscan.Select(ctx, db, &got.MsigResolution, `SELECT * FROM msig_resolution ORDER BY msig_id`); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlscan.Select(ctx, db, &got.Delegations, `SELECT * FROM delegations ORDER BY delegator_id`); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlscan.Select(ctx, db, &got.Exclusions, `SELECT * FROM exclusions ORDER BY group_name, actor_id, reason`); err != nil {
+				t.Fatal(err)
+			}
+			if got.Results, err = tally.Results(ctx, db, tally.DefaultRules); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(got); err != nil {
+				t.Fatal(err)
+			}
+			gotJSON := buf.Bytes()
+
+			goldenFile := filepath.Join(dir, "golden.json")
+			if *updateGolden {
+				if err := os.WriteFile(goldenFile, gotJSON, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotJSON, want) {
+				t.Errorf("%s: result differs from %s ( rerun with -update to accept )\n got: %s\nwant: %s", tc.desc, goldenFile, gotJSON, want)
+			}
+		})
+	}
+}
+
+func TestTallyAuditTrail(t *testing.T) {
+	ctx := context.Background()
+	db := loadFixtureDB(t, filepath.Join("testdata", "conflicting_ballots", "state.json"))
+
+	signer, err := filaddr.NewFromString("f1nvfp3sqenc3cqr5blwm3ztnofw5kf724zplvpea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, msg := int64(2162000), "bafy2bzace"
+	at := time.Date(2022, 9, 20, 10, 0, 0, 0, time.UTC)
+	if err := tallyBallots(ctx, db, []ballot{
+		{OptionID: 51, SignerAddress: signer, CreatedAt: at},
+		{OptionID: tally.OptionNay, SignerAddress: signer, CreatedAt: at.Add(time.Hour), Height: &height, Message: &msg},
+	}, nil, nil, tally.DefaultRules); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var got []struct {
+		OptionID    int
+		Disposition string
+		Height      *int64
+		Message     *string
+	}
+	if err := sqlscan.Select(ctx, db, &got, `SELECT option_id, disposition, height, message FROM ballots ORDER BY rowid`); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Disposition != ballotIgnored || got[1].Disposition != ballotCounted {
+		t.Fatalf("unexpected audit trail %+v", got)
+	}
+	if got[0].Height != nil || got[1].Height == nil || *got[1].Height != height || got[1].Message == nil || *got[1].Message != msg {
+		t.Errorf("provenance not recorded: %+v", got)
+	}
+
+	// the ignored ballot does not pre-empt the valid one
+	var votes []bool
+	if err := sqlscan.Select(ctx, db, &votes, `SELECT does_accept FROM votes WHERE via = $1`, tally.ViaBallot); err != nil {
+		t.Fatal(err)
+	}
+	if len(votes) != 1 || votes[0] {
+		t.Errorf("expected a single REJECT ballot vote, got %v", votes)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+	"golang.org/x/xerrors"
+)
+
+// Ballot JSON comes in two shapes:
+//
+//   - a versioned document {"Version":1,"Ballots":[...]}, as written by
+//     parsestate ballots. Decoded strictly: unknown fields are an error.
+//   - a bare array, as exported by FilPoll. The format is detected for every
+//     record, an array mixing formats is an error. Fields the tally does not
+//     use are reported, not rejected: the archived set must remain tallyable
+//     no matter what else it carries.
+//
+// Either way every record must carry all required fields and one of the
+// FIP-0036 options, every offending record is listed in the returned error.
+
+// no point spamming the terminal beyond this
+const maxReportedBallotErrors = 64
+
+type ballotFormat struct {
+	name string
+	// canonical field => key in the source records
+	fields map[string]string
+	// exact key match, or the case-insensitive one of encoding/json
+	exactKeys bool
+	// unknown keys fail the record
+	strict bool
+}
+
+var (
+	nativeBallotFormat = ballotFormat{
+		name: fmt.Sprintf("version %d", tally.BallotSchemaVersion),
+		fields: map[string]string{
+			"OptionID":      "OptionID",
+			"SignerAddress": "SignerAddress",
+			"CreatedAt":     "CreatedAt",
+			"Height":        "Height",
+			"Message":       "Message",
+		},
+		exactKeys: true,
+		strict:    true,
+	}
+	// the 2022-09-29 archive, see ballotSource
+	filpollArchiveFormat = ballotFormat{
+		name: "FilPoll archive",
+		fields: map[string]string{
+			"OptionID":      "OptionID",
+			"SignerAddress": "SignerAddress",
+			"CreatedAt":     "CreatedAt",
+		},
+	}
+	// https://api.filpoll.io/api/polls/{poll}/view-votes
+	filpollAPIFormat = ballotFormat{
+		name: "FilPoll API",
+		fields: map[string]string{
+			"OptionID":      "option_id",
+			"SignerAddress": "signer_address",
+			"CreatedAt":     "created_at",
+		},
+		exactKeys: true,
+	}
+)
+
+var requiredBallotFields = []string{"OptionID", "SignerAddress", "CreatedAt"}
+
+type ballotProblem struct {
+	index   int
+	problem string
+	record  json.RawMessage
+}
+
+func decodeBallots(src string, raw []byte) ([]ballot, error) {
+
+	raw = bytes.TrimSpace(raw)
+	var records []json.RawMessage
+	var format ballotFormat
+
+	if len(raw) > 0 && raw[0] == '{' {
+		var doc struct {
+			Version int
+			Ballots []json.RawMessage
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, xerrors.Errorf("unable to parse ballot document %s: %w", src, err)
+		}
+		if doc.Version != tally.BallotSchemaVersion {
+			return nil, xerrors.Errorf("ballot document %s is of unsupported version %d, only %d is understood", src, doc.Version, tally.BallotSchemaVersion)
+		}
+		records, format = doc.Ballots, nativeBallotFormat
+	} else {
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return nil, xerrors.Errorf("unable to parse ballot array %s: %w", src, err)
+		}
+		format = filpollArchiveFormat
+		for i, rec := range records {
+			f := detectArrayFormat(rec)
+			if i == 0 {
+				format = f
+			} else if f.name != format.name {
+				return nil, xerrors.Errorf("ballot array %s mixes formats: #0 is in %s format, #%d in %s format: %s", src, format.name, i, f.name, rec)
+			}
+		}
+	}
+
+	ballots := make([]ballot, 0, len(records))
+	var problems []ballotProblem
+	ignored := make(map[string]int)
+	for i, rec := range records {
+		b, unknown, err := format.parse(rec)
+		if err != nil {
+			problems = append(problems, ballotProblem{i, err.Error(), rec})
+			continue
+		}
+		for _, k := range unknown {
+			ignored[k]++
+		}
+		ballots = append(ballots, b)
+	}
+
+	if len(problems) > 0 {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d of %d ballots in %s ( %s format ) are invalid:", len(problems), len(records), src, format.name)
+		for i, p := range problems {
+			if i == maxReportedBallotErrors {
+				fmt.Fprintf(&sb, "\n\t... and %d more", len(problems)-i)
+				break
+			}
+			fmt.Fprintf(&sb, "\n\t#%d: %s: %s", p.index, p.problem, p.record)
+		}
+		return nil, xerrors.New(sb.String())
+	}
+
+	if len(ignored) > 0 {
+		keys := make([]string, 0, len(ignored))
+		for k := range ignored {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			log.Printf("ignoring field '%s' present in %d of %d %s ballots", k, ignored[k], len(records), format.name)
+		}
+	}
+
+	return ballots, nil
+}
+
+// detectArrayFormat tells the FilPoll formats apart, by their signer key
+func detectArrayFormat(rec json.RawMessage) ballotFormat {
+	var kv map[string]json.RawMessage
+	if err := json.Unmarshal(rec, &kv); err == nil {
+		if _, isAPI := kv[filpollAPIFormat.fields["SignerAddress"]]; isAPI {
+			return filpollAPIFormat
+		}
+	}
+	// not an object at all is reported by parse()
+	return filpollArchiveFormat
+}
+
+// parse returns the ballot and the record keys not part of the format
+func (f ballotFormat) parse(rec json.RawMessage) (ballot, []string, error) {
+	var b ballot
+
+	var kv map[string]json.RawMessage
+	if err := json.Unmarshal(rec, &kv); err != nil {
+		return b, nil, xerrors.Errorf("not an object: %w", err)
+	}
+
+	fields := make(map[string]json.RawMessage, len(f.fields))
+	var unknown []string
+	for k, v := range kv {
+		canonical, known := "", false
+		for c, sk := range f.fields {
+			if k == sk || (!f.exactKeys && strings.EqualFold(k, sk)) {
+				canonical, known = c, true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, k)
+			continue
+		}
+		if _, dup := fields[canonical]; dup {
+			return b, nil, xerrors.Errorf("field %s specified more than once", canonical)
+		}
+		fields[canonical] = v
+	}
+	sort.Strings(unknown)
+	if f.strict && len(unknown) > 0 {
+		return b, nil, xerrors.Errorf("unknown field(s) %s", strings.Join(unknown, ", "))
+	}
+
+	var missing []string
+	for _, c := range requiredBallotFields {
+		if v, found := fields[c]; !found || string(v) == "null" {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return b, nil, xerrors.Errorf("missing required field(s) %s", strings.Join(missing, ", "))
+	}
+
+	if err := json.Unmarshal(fields["OptionID"], &b.OptionID); err != nil {
+		return b, nil, xerrors.Errorf("invalid OptionID: %w", err)
+	}
+	if b.OptionID != tally.OptionYea && b.OptionID != tally.OptionNay {
+		return b, nil, xerrors.Errorf("unknown OptionID %d, FIP-0036 has only %d ( accept ) and %d ( reject )", b.OptionID, tally.OptionYea, tally.OptionNay)
+	}
+	var addr string
+	if err := json.Unmarshal(fields["SignerAddress"], &addr); err != nil {
+		return b, nil, xerrors.Errorf("invalid SignerAddress: %w", err)
+	}
+	var err error
+	if b.SignerAddress, err = filaddr.NewFromString(addr); err != nil {
+		return b, nil, xerrors.Errorf("invalid SignerAddress '%s': %w", addr, err)
+	}
+	if err := json.Unmarshal(fields["CreatedAt"], &b.CreatedAt); err != nil {
+		return b, nil, xerrors.Errorf("invalid CreatedAt: %w", err)
+	}
+	if b.CreatedAt.Equal(time.Time{}) {
+		return b, nil, xerrors.New("zero CreatedAt")
+	}
+	// provenance only, recorded in the audit trail
+	if v, found := fields["Height"]; found {
+		if err := json.Unmarshal(v, &b.Height); err != nil {
+			return b, nil, xerrors.Errorf("invalid Height: %w", err)
+		}
+	}
+	if v, found := fields["Message"]; found {
+		if err := json.Unmarshal(v, &b.Message); err != nil {
+			return b, nil, xerrors.Errorf("invalid Message: %w", err)
+		}
+	}
+
+	return b, unknown, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeBallots(t *testing.T) {
+	const alice = "f1nvfp3sqenc3cqr5blwm3ztnofw5kf724zplvpea"
+
+	for _, tc := range []struct {
+		name    string
+		json    string
+		want    int
+		wantErr []string
+	}{
+		{
+			name: "versioned document",
+			json: `{"Version":1,"Ballots":[{"OptionID":49,"SignerAddress":"f0100","CreatedAt":"2022-09-20T10:00:00Z","Height":2162000,"Message":"bafy2bzace"}]}`,
+			want: 1,
+		},
+		{
+			name:    "unsupported version",
+			json:    `{"Version":2,"Ballots":[]}`,
+			wantErr: []string{"unsupported version 2"},
+		},
+		{
+			name:    "unknown document field",
+			json:    `{"Version":1,"Ballots":[],"Poll":16}`,
+			wantErr: []string{`unknown field "Poll"`},
+		},
+		{
+			name: "every offending record is reported",
+			json: `{"Version":1,"Ballots":[
+				{"OptionID":49,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z"},
+				{"OptionID":49,"CreatedAt":"2022-09-20T10:00:00Z"},
+				{"OptionID":49,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z","Signature":"xx"},
+				{"OptionID":49,"SignerAddress":"f9nope","CreatedAt":"2022-09-20T10:00:00Z"},
+				{"optionid":49,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z"}
+			]}`,
+			wantErr: []string{
+				"4 of 5 ballots",
+				"#1: missing required field(s) SignerAddress",
+				"#2: unknown field(s) Signature",
+				"#3: invalid SignerAddress 'f9nope'",
+				"#4: unknown field(s) optionid",
+			},
+		},
+		{
+			name: "FilPoll archive, extra fields are ignored",
+			json: `[{"ID":7,"PollID":16,"optionid":50,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z","Signature":"xx"}]`,
+			want: 1,
+		},
+		{
+			name:    "FilPoll archive, required fields are not",
+			json:    `[{"ID":7,"OptionID":50,"SignerAddress":"` + alice + `","CreatedAt":null}]`,
+			wantErr: []string{"FilPoll archive format", "#0: missing required field(s) CreatedAt"},
+		},
+		{
+			name: "FilPoll API",
+			json: `[{"id":7,"option_id":49,"signer_address":"` + alice + `","created_at":"2022-09-20T10:00:00Z"}]`,
+			want: 1,
+		},
+		{
+			name:    "unknown option",
+			json:    `[{"OptionID":51,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z"}]`,
+			wantErr: []string{"#0: unknown OptionID 51"},
+		},
+		{
+			name: "mixed FilPoll formats",
+			json: `[
+				{"OptionID":49,"SignerAddress":"` + alice + `","CreatedAt":"2022-09-20T10:00:00Z"},
+				{"option_id":49,"signer_address":"` + alice + `","created_at":"2022-09-20T10:00:00Z"}
+			]`,
+			wantErr: []string{"mixes formats", "#0 is in FilPoll archive format, #1 in FilPoll API format"},
+		},
+		{
+			name:    "FilPoll API with a changed field",
+			json:    `[{"id":7,"option":49,"signer_address":"` + alice + `","created_at":"2022-09-20T10:00:00Z"}]`,
+			wantErr: []string{"FilPoll API format", "#0: missing required field(s) OptionID"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeBallots("test.json", []byte(tc.json))
+			if len(tc.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("expected an error, got %d ballots", len(got))
+				}
+				for _, w := range tc.wantErr {
+					if !strings.Contains(err.Error(), w) {
+						t.Errorf("error does not mention '%s':\n%s", w, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tc.want {
+				t.Errorf("got %d ballots, want %d", len(got), tc.want)
+			}
+			for _, b := range got {
+				if b.SignerAddress.Empty() || b.CreatedAt.IsZero() {
+					t.Errorf("incompletely decoded ballot %+v", b)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBallotsProvenance(t *testing.T) {
+	got, err := decodeBallots("test.json", []byte(`{"Version":1,"Ballots":[
+		{"OptionID":49,"SignerAddress":"f0100","CreatedAt":"2022-09-20T10:00:00Z","Height":2162000,"Message":"bafy2bzace"},
+		{"OptionID":50,"SignerAddress":"f0101","CreatedAt":"2022-09-20T10:00:00Z"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := got[0]; b.Height == nil || *b.Height != 2162000 || b.Message == nil || *b.Message != "bafy2bzace" {
+		t.Errorf("provenance lost: %+v", b)
+	}
+	if b := got[1]; b.Height != nil || b.Message != nil {
+		t.Errorf("provenance made up: %+v", b)
+	}
+}
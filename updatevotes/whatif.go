@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+// whatIf re-tallies the counted ballots of the audit trail, along with the
+// delegations of the last tally, under every variant of rules, and prints the
+// per-group outcome of each. Nothing is persisted.
+func whatIf(ctx context.Context, db *sql.DB, rules tally.Rules) error {
+
+	delegations, err := delegationsFromDB(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	variants := tally.RuleVariants(rules)
+	outcomes := make([]map[string]tally.Totals, len(variants))
+
+	for i, r := range variants {
+		log.Printf("Tallying variant %d/%d: %s", i+1, len(variants), r)
+
+		res, err := func() (map[string]tally.Totals, error) {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback() //nolint:errcheck
+
+			for _, s := range []string{
+				`DELETE FROM votes`,
+				`
+				INSERT INTO votes
+					( actor_id, does_accept, vote_received, via )
+				SELECT actor_id, option_id = ` + strconv.Itoa(tally.OptionYea) + `, created_at, '` + tally.ViaBallot + `'
+					FROM ballots
+				WHERE disposition = '` + ballotCounted + `'
+				`,
+			} {
+				if _, err := tx.ExecContext(ctx, s); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := tally.Delegate(ctx, tx, delegations); err != nil {
+				return nil, err
+			}
+			if _, err := tally.Propagate(ctx, tx, r); err != nil {
+				return nil, err
+			}
+			return tally.Results(ctx, tx, r)
+		}()
+		if err != nil {
+			return err
+		}
+		outcomes[i] = res
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%-114s", "Rules ( * marks an outcome differing from the first row, the rules of the tally )")
+	for _, g := range tally.Groups {
+		fmt.Fprintf(&b, "  %-22s", g)
+	}
+	b.WriteString("\n")
+	for i, r := range variants {
+		fmt.Fprintf(&b, "%-114s", r)
+		for _, g := range tally.Groups {
+			t := outcomes[i][g]
+			mark := " "
+			if verdict(t) != verdict(outcomes[0][g]) {
+				mark = "*"
+			}
+			fmt.Fprintf(&b, "  %6s %-8s%s      ", pct(t.Yea, t.Yea+t.Nay), verdict(t), mark)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\nTIE: as much Yea as Nay weight, which does not make a majority either way. NO-VOTES: no weight voted at all.\n")
+	log.Println(b.String())
+
+	return nil
+}
+
+// verdict is the outcome of a group: a strict majority of the voted weight
+// accepts or rejects, anything else is reported as such rather than folded
+// into either
+func verdict(t tally.Totals) string {
+	// the floats of exact groups are rounded: a near-tie may not be one
+	cmp, voted := 0, t.Yea+t.Nay > 0
+	if t.Exact != nil {
+		cmp = t.Exact.Yea.Int.Cmp(t.Exact.Nay.Int)
+		voted = t.Exact.Yea.Sign() > 0 || t.Exact.Nay.Sign() > 0
+	} else if t.Yea > t.Nay {
+		cmp = 1
+	} else if t.Yea < t.Nay {
+		cmp = -1
+	}
+
+	switch {
+	case !voted:
+		return "NO-VOTES"
+	case cmp > 0:
+		return "ACCEPT"
+	case cmp < 0:
+		return "REJECT"
+	default:
+		return "TIE"
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	filbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/ribasushi/fil-fip36-vote-tally/tally"
+)
+
+func TestVerdict(t *testing.T) {
+	exact := func(yea, nay int64) tally.Totals {
+		// floats rounded to a tie
+		return tally.Totals{Yea: 1e18, Nay: 1e18, Exact: &tally.ExactTotals{
+			Abstain: filbig.Zero(),
+			Yea:     filbig.Add(filbig.NewInt(1e18), filbig.NewInt(yea)),
+			Nay:     filbig.Add(filbig.NewInt(1e18), filbig.NewInt(nay)),
+		}}
+	}
+
+	for _, tc := range []struct {
+		t        tally.Totals
+		verdict  string
+		yeaShare string
+	}{
+		{tally.Totals{Yea: 2, Nay: 1}, "ACCEPT", "66.7%"},
+		{tally.Totals{Yea: 1, Nay: 2}, "REJECT", "33.3%"},
+		{tally.Totals{Yea: 1, Nay: 1}, "TIE", "50.0%"},
+		{tally.Totals{Abstain: 5}, "NO-VOTES", "-"},
+		{exact(1, 0), "ACCEPT", "50.0%"},
+		{exact(0, 0), "TIE", "50.0%"},
+		{tally.Totals{Exact: &tally.ExactTotals{Abstain: filbig.NewInt(5), Yea: filbig.Zero(), Nay: filbig.Zero()}}, "NO-VOTES", "-"},
+	} {
+		if v := verdict(tc.t); v != tc.verdict {
+			t.Errorf("%+v: verdict %s, expected %s", tc.t, v, tc.verdict)
+		}
+		if p := pct(tc.t.Yea, tc.t.Yea+tc.t.Nay); p != tc.yeaShare {
+			t.Errorf("%+v: Yea share %s, expected %s", tc.t, p, tc.yeaShare)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// main is main is main
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"golang.org/x/xerrors"
+)
+
+// run this against a fresh download, before parsestate spends ages indexing it
+const defaultSnapshot = `data/minimal_finality_stateroots_2163120_2022-09-15_00-00-00.car`
+
+// no point spamming the terminal beyond this
+const maxReportedFailures = 64
+
+type scanTotals struct {
+	blocks      int64
+	bytes       int64
+	badBlocks   int64
+	firstBadOff int64
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [car-file]\n\nDefault car-file: %s\n", os.Args[0], defaultSnapshot)
+	}
+	flag.Parse()
+
+	carFile := defaultSnapshot
+	if flag.NArg() > 0 {
+		carFile = flag.Arg(0)
+	}
+
+	tot, err := scanCar(carFile)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	log.Printf("Scanned %d blocks ( %d MiB ) in %s", tot.blocks, tot.bytes>>20, carFile)
+	if tot.badBlocks > 0 {
+		log.Fatalf("FAILED: %d blocks do not match their CIDs, first one at file offset %d", tot.badBlocks, tot.firstBadOff)
+	}
+	log.Println("OK: every block matches its CID")
+}
+
+func scanCar(carFile string) (*scanTotals, error) {
+	fh, err := os.Open(carFile)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to open car %s: %w", carFile, err)
+	}
+	defer fh.Close() //nolint:errcheck
+
+	cr, err := car.NewReader(fh)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read car header of %s: %w", carFile, err)
+	}
+
+	// all reported offsets are absolute within the file, so one can `dd` the bad section out
+	var pos int64
+	if cr.Version == 2 {
+		pos = int64(cr.Header.DataOffset)
+	}
+	rdr := &countingReader{
+		r: bufio.NewReaderSize(cr.DataReader(), 1<<20),
+		n: pos,
+	}
+
+	hdrLen, err := binary.ReadUvarint(rdr)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read carv1 header length: %w", err)
+	}
+	if _, err := io.CopyN(io.Discard, rdr, int64(hdrLen)); err != nil {
+		return nil, xerrors.Errorf("unable to read carv1 header: %w", err)
+	}
+
+	tot := &scanTotals{firstBadOff: -1}
+	lastReport := time.Now()
+	buf := make([]byte, 0, 1<<20)
+
+	for {
+		secOff := rdr.n
+
+		secLen, err := binary.ReadUvarint(rdr)
+		if err == io.EOF {
+			return tot, nil
+		} else if err != nil {
+			return tot, xerrors.Errorf("unable to read section length at offset %d: %w", secOff, err)
+		}
+
+		// lotus exports are occasionally zero-padded at the end
+		if secLen == 0 {
+			return tot, nil
+		}
+
+		if uint64(cap(buf)) < secLen {
+			buf = make([]byte, secLen)
+		}
+		buf = buf[:secLen]
+		if _, err := io.ReadFull(rdr, buf); err != nil {
+			return tot, xerrors.Errorf("truncated section of length %d at offset %d: %w", secLen, secOff, err)
+		}
+
+		cidLen, c, err := cid.CidFromBytes(buf)
+		if err != nil {
+			return tot, xerrors.Errorf("undecodeable CID in section at offset %d: %w", secOff, err)
+		}
+
+		tot.blocks++
+		tot.bytes += int64(secLen) - int64(cidLen)
+
+		actual, err := c.Prefix().Sum(buf[cidLen:])
+		if err != nil {
+			return tot, xerrors.Errorf("unable to rehash block %s at offset %d: %w", c, secOff, err)
+		}
+		if !actual.Equals(c) {
+			tot.badBlocks++
+			if tot.firstBadOff < 0 {
+				tot.firstBadOff = secOff
+			}
+			if tot.badBlocks <= maxReportedFailures {
+				log.Printf("CORRUPT block %s at offset %d ( length %d ): content hashes to %s", c, secOff, secLen, actual)
+			}
+		}
+
+		if time.Since(lastReport) > 10*time.Second {
+			lastReport = time.Now()
+			log.Printf("... %d blocks verified, at offset %d MiB", tot.blocks, rdr.n>>20)
+		}
+	}
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blkfmt "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multihash"
+)
+
+// writeCar returns the path of a CARv2 holding the given payloads, and the
+// path of the bare CARv1 it wraps
+func writeCar(t *testing.T, payloads ...string) (string, string, []cid.Cid) {
+	t.Helper()
+
+	var blks []blkfmt.Block
+	for _, s := range payloads {
+		mh, err := multihash.Sum([]byte(s), multihash.BLAKE2B_MIN+31, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := blkfmt.NewBlockWithCid([]byte(s), cid.NewCidV1(cid.DagCBOR, mh))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, b)
+	}
+	cids := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		cids[i] = b.Cid()
+	}
+
+	v2File := filepath.Join(t.TempDir(), "fixture.car")
+	rw, err := carbs.OpenReadWrite(v2File, cids[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.PutMany(context.Background(), blks); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(v2File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := car.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1File := filepath.Join(t.TempDir(), "fixture_v1.car")
+	if err := os.WriteFile(v1File, raw[cr.Header.DataOffset:cr.Header.DataOffset+cr.Header.DataSize], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return v2File, v1File, cids
+}
+
+// corrupt flips the first byte of payload within f, returning the offset of its section
+func corrupt(t *testing.T, f string, c cid.Cid, payload string) int64 {
+	t.Helper()
+
+	raw, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidOff := bytes.Index(raw, c.Bytes())
+	if cidOff < 0 || !bytes.HasPrefix(raw[cidOff+c.ByteLen():], []byte(payload)) {
+		t.Fatalf("section of %s not found in %s", c, f)
+	}
+	raw[cidOff+c.ByteLen()] ^= 0xff
+	if err := os.WriteFile(f, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single-byte section length precedes the CID
+	return int64(cidOff - 1)
+}
+
+func TestScanCar(t *testing.T) {
+	payloads := []string{"first block", "second block", "third block"}
+
+	for _, v := range []string{"v2", "v1"} {
+		t.Run(v, func(t *testing.T) {
+			v2File, v1File, cids := writeCar(t, payloads...)
+			f := v2File
+			if v == "v1" {
+				f = v1File
+			}
+
+			tot, err := scanCar(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tot.blocks != 3 || tot.badBlocks != 0 || tot.firstBadOff != -1 {
+				t.Fatalf("unexpected totals of a pristine car: %+v", *tot)
+			}
+
+			expOff := corrupt(t, f, cids[1], payloads[1])
+			tot, err = scanCar(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tot.blocks != 3 || tot.badBlocks != 1 {
+				t.Fatalf("expected 1 corrupt block out of 3, got %+v", *tot)
+			}
+			if tot.firstBadOff != expOff {
+				t.Fatalf("expected the corrupt section to be reported at offset %d, got %d", expOff, tot.firstBadOff)
+			}
+		})
+	}
+}